@@ -3,12 +3,10 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
-	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/olaris/olaris-rename/identify"
@@ -16,30 +14,96 @@ import (
 
 // NewApp creates a new environment
 func NewApp(recursive bool, action string, movieFolder string, seriesFolder string, mode string, tmdbLookup bool, minFileSize string, forceMovie bool, forceSeries bool) *App {
-	return &App{recursive: recursive, action: action, movieFolder: movieFolder, seriesFolder: seriesFolder, mode: mode, tmdbLookup: tmdbLookup, minFileSize: minFileSize, forceMovie: forceMovie, forceSeries: forceSeries}
+	return &App{
+		recursive:    recursive,
+		action:       action,
+		movieFolder:  movieFolder,
+		seriesFolder: seriesFolder,
+		mode:         mode,
+		tmdbLookup:   tmdbLookup,
+		minFileSize:  minFileSize,
+		forceMovie:   forceMovie,
+		forceSeries:  forceSeries,
+		movieFormat:  identify.DefaultMovieFormat,
+		seriesFormat: identify.DefaultSeriesFormat,
+		jobs:         1,
+		sanitize:     identify.DefaultSanitizeProfile,
+		onConflict:   "skip",
+		onCollision:  "largest",
+		junk:         DefaultJunk,
+	}
 }
 
-// App is a Standard environment with options
+// App is a Standard environment with options. It is not modified during a run so it can be
+// shared between the identification workers.
 type App struct {
-	action       string
-	movieFolder  string
-	seriesFolder string
-	minFileSize  string
-	mode         string
-	recursive    bool
-	tmdbLookup   bool
-	forceMovie   bool
-	forceSeries  bool
+	action           string
+	movieFolder      string
+	seriesFolder     string
+	minFileSize      string
+	mode             string
+	recursive        bool
+	tmdbLookup       bool
+	forceMovie       bool
+	forceSeries      bool
+	movieFormat      string
+	seriesFormat     string
+	specialsFormat   string
+	extrasFormat     string
+	language         string
+	fallbackLanguage string
+	jobs             int
+	localDB          *identify.LocalDB
+	sanitize         string
+	replacements     map[string]string
+	overrides        []Override
+	// journal records executed operations so they can be undone, it is nil when not recording.
+	journal *Journal
+	// onConflict is the policy for targets that already exist, see conflictPolicies.
+	onConflict string
+	// upgrade replaces worse releases of the same movie or episode, see checkUpgrade.
+	upgrade        bool
+	qualityRanking identify.QualityRanking
+	trash          string
+	verifyCopies   bool
+	// reflinkFallback is the action used by --action=reflink when the filesystem can't clone.
+	reflinkFallback string
+	// onCollision decides which file is kept when several files have the same target.
+	onCollision string
+	// cleanup removes source folders with nothing but junk left after moving files out.
+	cleanup bool
+	junk    []string
+	// hooks run after every operation and at the end of a run.
+	hooks []Hook
+	// mediaServers are asked to refresh the folders touched by a run.
+	mediaServers []MediaServer
+	// planOut is the file the plan of a dry-run is written to.
+	planOut string
 }
 
 // PlannedOperation represents a file operation that will be performed
 type PlannedOperation struct {
-	SourcePath string
-	TargetPath string
-	Action     string
-	IsMovie    bool
-	IsSeries   bool
-	File       identify.ParsedFile
+	SourcePath string `json:"source"`
+	TargetPath string `json:"target"`
+	Action     string `json:"action"`
+	IsMovie    bool   `json:"is_movie"`
+	IsSeries   bool   `json:"is_series"`
+	// SourceState is the source while planning, it is used to refuse outdated plans.
+	SourceState *FileState `json:"source_state,omitempty"`
+	// Conflict is set when the target already existed while planning.
+	Conflict bool `json:"conflict,omitempty"`
+	// Replaces and Inferior are the outcome of the upgrade check while planning.
+	Replaces []string `json:"replaces,omitempty"`
+	Inferior bool     `json:"inferior,omitempty"`
+	// CollidesWith lists the sources of other operations in the plan with the same target.
+	CollidesWith []string `json:"collides_with,omitempty"`
+	// Lost is set when another file was kept for the target, the operation is skipped then.
+	Lost bool `json:"lost,omitempty"`
+	// Skip is set for operations that are not executed, like the losers of a collision.
+	Skip bool `json:"skip,omitempty"`
+	// Result is what happened to the file after executing, see the result constants.
+	Result string              `json:"result,omitempty"`
+	File   identify.ParsedFile `json:"file"`
 }
 
 var actions = map[string]bool{
@@ -47,6 +111,7 @@ var actions = map[string]bool{
 	"symlink":  true,
 	"hardlink": true,
 	"copy":     true,
+	"reflink":  true,
 	"move":     true,
 }
 
@@ -90,29 +155,6 @@ func ensurePath(pathName string) error {
 	return nil
 }
 
-func copyFileContents(src, dst string) (err error) {
-	in, err := os.Open(src)
-	if err != nil {
-		return
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return
-	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
-		}
-	}()
-	if _, err = io.Copy(out, in); err != nil {
-		return
-	}
-	err = out.Sync()
-	return
-}
-
 func (e *App) minFileSizeBytes() int64 {
 	mb, err := strconv.Atoi(e.minFileSize)
 	if err != nil {
@@ -122,323 +164,290 @@ func (e *App) minFileSizeBytes() int64 {
 	return int64(mb) * 1000 * 1000
 }
 
+// identifyOptions returns the options used to parse files in the given mode
+func (e *App) identifyOptions(mode string) identify.Options {
+	return identify.Options{
+		Lookup:           e.tmdbLookup,
+		MovieFormat:      e.movieFormat,
+		SeriesFormat:     e.seriesFormat,
+		SpecialsFormat:   e.specialsFormat,
+		ExtrasFormat:     e.extrasFormat,
+		ForceMovie:       e.forceMovie,
+		ForceSeries:      e.forceSeries,
+		Mode:             mode,
+		Language:         e.language,
+		FallbackLanguage: e.fallbackLanguage,
+		LocalDB:          e.localDB,
+		Sanitize:         e.sanitize,
+		Replacements:     e.replacements,
+	}
+}
+
 // collectPlannedOperations collects all the file operations that would be performed
 func (e *App) collectPlannedOperations(path string) ([]PlannedOperation, error) {
 	var operations []PlannedOperation
-	
-	// Temporarily set mode to dry-run to collect operations without executing
-	originalMode := e.mode
-	e.mode = "dry-run"
-	defer func() { e.mode = originalMode }()
-	
-	fi, err := os.Stat(path)
+
+	paths, err := e.discoverFiles(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if fi.IsDir() {
-		if !e.recursive {
-			files, err := filepath.Glob(filepath.Join(path, "*"))
-			if err != nil {
-				return nil, err
-			}
-			for _, f := range files {
-				ops := e.collectFileOperations(f)
-				operations = append(operations, ops...)
-			}
-		} else if e.recursive {
-			err := filepath.Walk(path+"/", func(filePath string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if info.Mode().IsRegular() {
-					ops := e.collectFileOperations(filePath)
-					operations = append(operations, ops...)
-				}
-				return nil
-			})
-			if err != nil {
-				return nil, err
-			}
+	// Files are always identified in dry-run mode, executeOperations acts on them later on.
+	e.identifyFiles(paths, "dry-run", func(res identifiedFile) {
+		if op, ok := e.planOperation(res); ok {
+			operations = append(operations, op)
 		}
-	} else {
-		operations = e.collectFileOperations(path)
-	}
-	
+	})
+	e.resolveCollisions(operations)
+
 	return operations, nil
 }
 
 // collectFileOperations collects the planned operations for a single file
 func (e *App) collectFileOperations(filePath string) []PlannedOperation {
-	var operations []PlannedOperation
-	
-	ext := filepath.Ext(filePath)
-	info, err := os.Stat(filePath)
-	if err != nil {
-		return operations
-	}
-	
-	if !info.Mode().IsRegular() {
-		return operations
+	if op, ok := e.planOperation(e.identifyFile(filePath, "dry-run", log.StandardLogger())); ok {
+		return []PlannedOperation{op}
 	}
+	return nil
+}
 
-	if identify.SupportedVideoExtensions[ext] {
-		if info.Size() < e.minFileSizeBytes() {
-			return operations
-		}
+// planOperation returns the operation that would be performed for an identified file
+func (e *App) planOperation(res identifiedFile) (PlannedOperation, bool) {
+	file := res.file
+	if res.skip || !(file.IsMovie || file.IsSeries) {
+		return PlannedOperation{}, false
 	}
 
-	file := identify.NewParsedFile(filePath, identify.Options{
-		Lookup: e.tmdbLookup, 
-		MovieFormat: *movieFormat, 
-		SeriesFormat: *seriesFormat, 
-		ForceMovie: e.forceMovie, 
-		ForceSeries: e.forceSeries, 
-		Mode: "dry-run", // Force dry-run mode for collection
-	})
-
-	if file.IsMovie || file.IsSeries {
-		var targetPath string
-		
-		if e.action == "rename" {
-			source, err := filepath.Abs(file.SourcePath())
-			if err != nil {
-				return operations
-			}
-			sourceDir := filepath.Dir(source)
-			targetFullName := file.TargetName()
-			targetFileName := filepath.Base(targetFullName)
-			targetPath = filepath.Join(sourceDir, targetFileName)
-		} else {
-			var targetFolder string
-			if file.IsMovie {
-				targetFolder = e.movieFolder
-			} else {
-				targetFolder = e.seriesFolder
-			}
-			targetPath = filepath.Join(targetFolder, file.TargetName())
-		}
-		
-		operations = append(operations, PlannedOperation{
-			SourcePath: file.SourcePath(),
-			TargetPath: targetPath,
-			Action:     e.action,
-			IsMovie:    file.IsMovie,
-			IsSeries:   file.IsSeries,
-			File:       file,
-		})
-	}
-	
-	return operations
+	source, target, err := e.operationPaths(file)
+	if err != nil {
+		log.WithFields(log.Fields{"file": file.Filename, "error": err}).Errorln("Could not determine the target of file")
+		return PlannedOperation{}, false
+	}
+	upgrade := e.checkUpgrade(file, source, target)
+	state, err := fileState(source)
+	if err != nil {
+		log.WithFields(log.Fields{"file": file.Filename, "error": err}).Errorln("Could not stat file")
+		return PlannedOperation{}, false
+	}
+
+	return PlannedOperation{
+		SourcePath:  source,
+		SourceState: state,
+		TargetPath:  target,
+		Action:      e.action,
+		IsMovie:     file.IsMovie,
+		IsSeries:    file.IsSeries,
+		Conflict:    targetConflicts(source, target),
+		Replaces:    upgrade.Replaces,
+		Inferior:    upgrade.Inferior,
+		File:        file,
+	}, true
 }
 
-// promptForConfirmation displays the planned operations and asks for user confirmation
-func (e *App) promptForConfirmation(operations []PlannedOperation) bool {
-	if len(operations) == 0 {
-		fmt.Println("No files to process.")
-		return false
-	}
-	
-	fmt.Printf("\nFound %d file(s) to process:\n\n", len(operations))
-	
-	// Get current working directory for relative path calculation
-	cwd, err := os.Getwd()
+// operationPaths returns the absolute source path and the target path of the file.
+func (e *App) operationPaths(file identify.ParsedFile) (string, string, error) {
+	source, err := filepath.Abs(file.SourcePath())
 	if err != nil {
-		// If we can't get cwd, fall back to absolute paths
-		cwd = ""
-	}
-	
-	for i, op := range operations {
-		fmt.Printf("%d. %s\n", i+1, op.Action)
-		
-		// Convert to relative paths
-		fromPath := op.SourcePath
-		toPath := op.TargetPath
-		
-		if cwd != "" {
-			if relFrom, err := filepath.Rel(cwd, op.SourcePath); err == nil {
-				fromPath = relFrom
-			}
-			if relTo, err := filepath.Rel(cwd, op.TargetPath); err == nil {
-				toPath = relTo
-			}
-		}
-		
-		fmt.Printf("   From: %s\n", fromPath)
-		fmt.Printf("   To:   %s\n", toPath)
-		fmt.Println()
-	}
-	
-	fmt.Print("Do you want to proceed with these operations? (y/N): ")
-	reader := bufio.NewReader(os.Stdin)
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		log.WithError(err).Errorln("Error reading user input")
-		return false
+		return "", "", err
+	}
+	if e.action == "rename" {
+		// Renames stay in the same folder, so only the file name of the target is used.
+		return source, filepath.Join(filepath.Dir(source), filepath.Base(file.TargetName())), nil
 	}
-	
-	response = strings.TrimSpace(strings.ToLower(response))
-	return response == "y" || response == "yes"
+	return source, filepath.Join(e.targetFolder(file), file.TargetName()), nil
 }
 
-// executeOperations performs the actual file operations
-func (e *App) executeOperations(operations []PlannedOperation) {
-	for _, op := range operations {
-		// Update the ParsedFile's mode to force execution
-		op.File.Options.Mode = "force"
-		
-		var err error
-		if e.action == "rename" {
-			err = actRename(op.File, e.action)
-		} else {
-			var targetFolder string
-			if op.IsMovie {
-				targetFolder = e.movieFolder
+// targetFolder returns the library folder the given file belongs in
+func (e *App) targetFolder(file identify.ParsedFile) string {
+	if o := e.overrideFor(file); o != nil && o.TargetFolder != "" {
+		return o.TargetFolder
+	}
+	if file.IsMovie {
+		return e.movieFolder
+	}
+	return e.seriesFolder
+}
+
+// stdin is shared by all prompts, so input buffered by one of them isn't lost for the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// executeOperations performs the actual file operations, the result of every operation is
+// stored in its Result. In dry-run mode the operations are only logged. An error is returned
+// when a hook aborted the run, the remaining operations are skipped then.
+func (e *App) executeOperations(operations []PlannedOperation) error {
+	mode := "force"
+	if e.mode == "dry-run" {
+		mode = "dry-run"
+	}
+	for i := range operations {
+		op := &operations[i]
+		if op.Skip {
+			logger := log.WithFields(log.Fields{"source": op.SourcePath, "target": op.TargetPath})
+			if len(op.CollidesWith) > 0 {
+				logger.WithField("collidesWith", op.CollidesWith).Warnln("Another file in this run has the same target, skipping file.")
 			} else {
-				targetFolder = e.seriesFolder
+				logger.Infoln("File was deselected, skipping file.")
 			}
-			err = act(op.File, targetFolder, e.action)
+			op.Result = resultSkipped
+			continue
+		}
+		op.File.Options.Mode = mode
+
+		result, target, err := e.perform(*op)
+		op.Result = result
+		if target != "" {
+			op.TargetPath = target
 		}
-		
 		if err != nil {
 			log.WithFields(log.Fields{"error": err, "source": op.SourcePath, "target": op.TargetPath}).Errorln("Error processing file")
 		}
-	}
-}
-
-func (e *App) walkRecursive(dir string) error {
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+		if !placed(result) {
+			continue
 		}
-
-		if info.Mode().IsRegular() {
-			e.checkFile(path)
+		if err := e.runHooks(hookOperation, newOperationPayload(*op), operationHookEnv(*op)); err != nil {
+			for j := i + 1; j < len(operations); j++ {
+				operations[j].Result = resultSkipped
+			}
+			return err
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
-func (e *App) checkFile(filePath string) {
-	var err error
-	log.WithFields(log.Fields{"filePath": filePath}).Debugln("checking file")
-
-	ext := filepath.Ext(filePath)
-
-	info, err := os.Stat(filePath)
+// perform acts on the file, resolving a conflict with an existing target using the
+// --on-conflict policy, and records the operation in the journal. It returns the result and
+// the target the file ended up at.
+func (e *App) perform(op PlannedOperation) (string, string, error) {
+	file, target := op.File, op.TargetPath
+	source, err := filepath.Abs(op.SourcePath)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "filePath": filePath}).Errorln("received error while statting file.")
-		return
-	}
-	if !info.Mode().IsRegular() {
-		log.WithFields(log.Fields{"filePath": filePath}).Debugln("File is a directory, moving on.")
-		return
+		return resultFailed, target, err
 	}
+	logger := log.WithFields(log.Fields{"target": target, "source": source, "action": e.action})
+	dryRun := file.Options.Mode == "dry-run"
 
-	if identify.SupportedVideoExtensions[ext] {
-		if info.Size() < e.minFileSizeBytes() {
-			log.WithFields(log.Fields{"filePath": filePath, "minSize": e.minFileSizeBytes(), "size": info.Size()}).Warnln("file is smaller then the given limit, not processing.")
-			return
+	upgrade := e.checkUpgrade(file, source, target)
+	if upgrade.Inferior {
+		logger.WithField("existing", upgrade.Existing).Warnln("The library already has this in the same or a better quality, skipping file.")
+		return resultSkipped, target, nil
+	}
+	if dryRun {
+		for _, replaced := range upgrade.Replaces {
+			logger.WithField("replaces", replaced).Infoln("DRY-RUN: Would replace a worse release, moving it to the trash folder")
 		}
 	}
 
-	file := identify.NewParsedFile(filePath, identify.Options{Lookup: e.tmdbLookup, MovieFormat: *movieFormat, SeriesFormat: *seriesFormat, ForceMovie: e.forceMovie, ForceSeries: e.forceSeries, Mode: e.mode})
-
-	if file.IsMovie {
-		log.Debugln("File is a MovieFile")
-		if e.action == "rename" {
-			err = actRename(file, e.action)
-		} else {
-			err = act(file, e.movieFolder, e.action)
-		}
-	} else if file.IsSeries {
-		log.Debugln("File is a SeriesFile")
-		if e.action == "rename" {
-			err = actRename(file, e.action)
-		} else {
-			err = act(file, e.seriesFolder, e.action)
+	decision := resultDone
+	// A replaced target only goes to the trash once the file is in place, it does not conflict.
+	if !containsPath(upgrade.Replaces, target) {
+		decision, err = resolveConflict(e.onConflict, source, target)
+		if err != nil {
+			logger.WithError(err).Errorln("Target already exists")
+			return resultFailed, target, err
 		}
 	}
-
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Errorln("Received error while acting on parsed file")
+	if decision == resultSuffixed {
+		target = suffixedTarget(target)
+		logger = logger.WithField("target", target)
+	}
+	if len(upgrade.Replaces) > 0 && decision == resultDone {
+		decision = resultUpgraded
 	}
 
-	log.WithFields(log.Fields{"filePath": filePath}).Debugln("Done checking file")
-}
-
-func actRename(p identify.ParsedFile, action string) error {
-	source, err := filepath.Abs(p.SourcePath())
-	if err != nil {
-		return err
+	if dryRun {
+		if decision == resultSkipped {
+			logger.Infoln("DRY-RUN: Target already exists, would skip file")
+		} else if decision != resultDone && decision != resultUpgraded {
+			logger.WithField("onConflict", e.onConflict).Infof("DRY-RUN: Target already exists, would act on file (%s)", decision)
+		} else {
+			logger.Infoln("DRY-RUN: Would act on file")
+		}
+		return decision, target, nil
 	}
 
-	// For rename action, we rename in the same directory as the source
-	// Extract just the filename part from TargetName (strip any folder structure)
-	sourceDir := filepath.Dir(source)
-	targetFullName := p.TargetName()
-	targetFileName := filepath.Base(targetFullName) // Get just the filename without folder structure
-	targetLocation := filepath.Join(sourceDir, targetFileName)
+	if decision == resultSkipped {
+		logger.WithField("onConflict", e.onConflict).Warnln("Target already exists, skipping file.")
+		return decision, target, nil
+	}
 
-	if p.Options.Mode == "dry-run" {
-		log.WithFields(log.Fields{"target": targetLocation, "source": source, "action": action}).Infoln("DRY-RUN: Would rename file")
-		return nil
+	created := missingDirs(filepath.Dir(target))
+	if err := ensurePath(filepath.Dir(target)); err != nil {
+		return resultFailed, target, err
 	}
-	
-	// For interactive and force modes, we proceed with the action
-	if p.Options.Mode == "interactive" {
-		// In interactive mode, we still execute since the user will have already confirmed
-		// The confirmation happens at a higher level
-		log.WithFields(log.Fields{"target": targetLocation, "source": source, "action": action}).Infoln("Acting on file")
-	} else if p.Options.Mode == "force" {
-		log.WithFields(log.Fields{"target": targetLocation, "source": source, "action": action}).Infoln("Acting on file")
+	// An overwritten target goes to the trash like a replaced release, so undo can bring it back.
+	replaces := upgrade.Replaces
+	if decision == resultOverwritten {
+		replaces = append(append([]string{}, replaces...), target)
 	}
 
-	if _, err := os.Lstat(targetLocation); err == nil {
-		log.Warnln("File already exists, doing nothing.")
-		return nil
+	logger.Infoln("Acting on file")
+	if err := e.place(source, target, replaces); err != nil {
+		return resultFailed, target, err
 	}
 
-	err = os.Rename(source, targetLocation)
-	if err != nil {
-		return err
+	if e.journal != nil {
+		if err := e.journal.recordOperation(e.action, source, target, created); err != nil {
+			logger.WithError(err).Errorln("Could not record operation in the journal")
+		}
 	}
 
-	return nil
+	// The new file is in place, the worse releases can go now. Keeping one around when this
+	// fails is better than losing it, so it is only logged.
+	for _, replaced := range upgrade.Replaces {
+		if replaced == target {
+			continue
+		}
+		if err := e.moveToTrash(replaced); err != nil {
+			logger.WithError(err).WithField("replaces", replaced).Errorln("Could not move replaced file to the trash folder")
+		}
+	}
+	return decision, target, nil
 }
 
-func act(p identify.ParsedFile, targetFolder, action string) error {
-	source, err := filepath.Abs(p.SourcePath())
-	if err != nil {
+// place transfers the file to the target. When the target itself is replaced, the file is
+// staged under a temporary name first and the old target only goes to the trash once the
+// transfer succeeded.
+func (e *App) place(source, target string, replaces []string) error {
+	staged := target
+	if containsPath(replaces, target) {
+		staged = target + stagedSuffix
+	}
+	if err := transfer(source, staged, e.action, transferOptions{verify: e.verifyCopies, reflinkFallback: e.reflinkFallback}); err != nil {
 		return err
 	}
-
-	targetLocation := filepath.Join(targetFolder, p.TargetName())
-
-	if p.Options.Mode == "dry-run" {
-		log.WithFields(log.Fields{"target": targetLocation, "source": source, "action": action}).Infoln("DRY-RUN: Would act on file")
+	if staged == target {
 		return nil
 	}
 
-	// For interactive and force modes, we proceed with the action
-	err = ensurePath(filepath.Dir(targetLocation))
-	if err != nil {
+	if err := e.moveToTrash(target); err != nil {
+		if revertErr := revertTransfer(e.action, source, staged); revertErr != nil {
+			log.WithFields(log.Fields{"error": revertErr, "staged": staged}).Errorln("Could not revert the transfer")
+		}
 		return err
 	}
+	return renameFile(staged, target)
+}
 
-	if p.Options.Mode == "interactive" {
-		// In interactive mode, we still execute since the user will have already confirmed
-		// The confirmation happens at a higher level
-		log.WithFields(log.Fields{"target": targetLocation, "source": source, "action": action}).Infoln("Acting on file")
-	} else if p.Options.Mode == "force" {
-		log.WithFields(log.Fields{"target": targetLocation, "source": source, "action": action}).Infoln("Acting on file")
+// revertTransfer undoes a transfer of source to target.
+func revertTransfer(action, source, target string) error {
+	if action == "move" || action == "rename" {
+		return moveFile(target, source)
 	}
+	return os.Remove(target)
+}
 
-	if _, err := os.Lstat(targetLocation); err == nil {
-		log.Warnln("File already exists, doing nothing.")
-		return nil
-	}
+// transferOptions tune how transfer performs actions.
+type transferOptions struct {
+	// verify enables checksum verification of copies, moves between filesystems are always
+	// verified.
+	verify bool
+	// reflinkFallback is the action used when the filesystem can't make reflinks.
+	reflinkFallback string
+}
 
+// transfer performs the action from source to target, target must not exist.
+func transfer(source, targetLocation, action string, opts transferOptions) error {
+	var err error
 	if action == "symlink" {
 		source, err = filepath.EvalSymlinks(source)
 		if err != nil {
@@ -466,12 +475,17 @@ func act(p identify.ParsedFile, targetFolder, action string) error {
 			return err
 		}
 	} else if action == "copy" {
-		err := copyFileContents(source, targetLocation)
+		err := copyFile(source, targetLocation, opts.verify)
 		if err != nil {
 			return err
 		}
-	} else if action == "move" {
-		err := os.Rename(source, targetLocation)
+	} else if action == "reflink" {
+		err := reflinkFile(source, targetLocation, opts)
+		if err != nil {
+			return err
+		}
+	} else if action == "move" || action == "rename" {
+		err := moveFile(source, targetLocation)
 		if err != nil {
 			return err
 		}
@@ -480,48 +494,57 @@ func act(p identify.ParsedFile, targetFolder, action string) error {
 	return nil
 }
 
-// StartRun starts a identification run
+// StartRun starts a identification run. All files are identified and planned first so files
+// that would end up with the same target can be detected, then the plan is executed.
 func (e *App) StartRun(path string) {
-	// Handle interactive mode specially
-	if e.mode == "interactive" {
-		operations, err := e.collectPlannedOperations(path)
-		if err != nil {
-			log.WithFields(log.Fields{"path": path, "error": err}).Errorf("could not collect planned operations")
+	operations, err := e.collectPlannedOperations(path)
+	if err != nil {
+		log.WithFields(log.Fields{"path": path, "error": err}).Errorf("could not collect planned operations")
+		return
+	}
+	if e.planOut != "" {
+		if err := writePlan(e.planOut, path, e.action, operations); err != nil {
+			log.WithFields(log.Fields{"path": e.planOut, "error": err}).Errorln("Could not write the plan")
 			return
 		}
-		
-		if e.promptForConfirmation(operations) {
-			fmt.Println("\nProceeding with operations...")
-			e.executeOperations(operations)
-			fmt.Printf("Completed processing %d file(s).\n", len(operations))
-		} else {
-			fmt.Println("Operation cancelled by user.")
-		}
-		return
+		log.WithFields(log.Fields{"path": e.planOut, "operations": len(operations)}).Infoln("Wrote plan, execute it with the apply command")
 	}
-	
-	// Handle dry-run and force modes with existing logic
-	fi, err := os.Stat(path)
-	if err != nil {
-		log.WithFields(log.Fields{"path": path, "error": err}).Errorf("could not open file")
+
+	if e.mode != "interactive" && e.mode != "tui" {
+		e.finishRun(path, operations)
+		if len(operations) > 0 {
+			log.WithFields(log.Fields{"files": len(operations), "results": summarizeResults(operations)}).Infoln("Done processing files")
+		}
 		return
 	}
 
-	if fi.IsDir() {
-		if !e.recursive {
-			log.Infof("Scanning non-recursive path '%s'", path)
-			files, err := filepath.Glob(filepath.Join(path, "*"))
-			if err != nil {
-				log.WithFields(log.Fields{"error": err}).Errorln("Received error while discovering files in folder")
-			}
-			for _, f := range files {
-				e.checkFile(f)
-			}
-		} else if e.recursive {
-			log.Infof("Scanning path '%s' recursively", path)
-			e.walkRecursive(path + "/")
-		}
+	accepted := false
+	if e.mode == "tui" {
+		accepted = e.reviewInTerminalUI(operations)
+	} else {
+		accepted = e.reviewOperations(stdin, operations)
+	}
+	if accepted {
+		fmt.Println("\nProceeding with operations...")
+		e.finishRun(path, operations)
+		fmt.Printf("Completed processing %d file(s): %s.\n", len(operations), summarizeResults(operations))
 	} else {
-		e.checkFile(path)
+		fmt.Println("Operation cancelled by user.")
+	}
+}
+
+// finishRun executes the plan, cleans up the source folders, refreshes the media servers and
+// runs the hooks for the end of the run.
+func (e *App) finishRun(path string, operations []PlannedOperation) {
+	if err := e.executeOperations(operations); err != nil {
+		log.WithError(err).Errorln("Run aborted, remaining files are skipped")
+	}
+	e.cleanupSources(path, operations)
+	e.refreshMediaServers(operations)
+	if len(operations) == 0 {
+		return
+	}
+	if err := e.runHooks(hookRun, newRunPayload(e.action, operations), map[string]string{"OLARIS_EVENT": hookRun}); err != nil {
+		log.WithError(err).Errorln("Could not finish the run")
 	}
 }
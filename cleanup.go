@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultJunk are the leftovers that are removed by --cleanup when no list is configured.
+// Patterns ending in a slash match folders, which are removed with everything inside.
+var DefaultJunk = []string{
+	"*.nfo", "*.txt", "*.jpg", "*.jpeg", "*.png", "*.sfv", "*.srr", "*.md5", "*.url",
+	".DS_Store", "Thumbs.db", "Sample/", "Samples/", "Proof/", "Screens/",
+}
+
+// validateJunk checks the patterns of the junk list.
+func validateJunk(patterns []string) error {
+	for _, p := range patterns {
+		if strings.TrimSuffix(p, "/") == "" {
+			return fmt.Errorf("empty junk pattern")
+		}
+		if _, err := filepath.Match(strings.TrimSuffix(p, "/"), ""); err != nil {
+			return fmt.Errorf("invalid junk pattern '%s': %w", p, err)
+		}
+	}
+	return nil
+}
+
+// isJunk returns whether the name matches one of the patterns, folders only match patterns
+// ending in a slash.
+func isJunk(patterns []string, name string, dir bool) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/") != dir {
+			continue
+		}
+		if ok, _ := filepath.Match(strings.ToLower(strings.TrimSuffix(p, "/")), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupSources removes the source folders of moved files when only junk is left in them.
+// Folders are only removed inside root and never root itself, files that are not on the junk
+// list are never removed. In dry-run mode the removals are only logged.
+func (e *App) cleanupSources(root string, operations []PlannedOperation) {
+	if !e.cleanup || e.action != "move" {
+		return
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return
+	}
+	inside := root
+	if !strings.HasSuffix(inside, string(filepath.Separator)) {
+		inside += string(filepath.Separator)
+	}
+
+	// In a dry-run the moved files are still there, they don't count as leftovers.
+	moved := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, op := range operations {
+		if !placed(op.Result) {
+			continue
+		}
+		source, err := filepath.Abs(op.SourcePath)
+		if err != nil {
+			continue
+		}
+		moved[source] = true
+		dirs[filepath.Dir(source)] = true
+	}
+
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	// Deepest folders first, so parents see the result of cleaning their children.
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	removed := make(map[string]bool)
+	for _, dir := range sorted {
+		for ; strings.HasPrefix(dir, inside); dir = filepath.Dir(dir) {
+			if removed[dir] {
+				continue
+			}
+			var junk []string
+			if !e.onlyJunk(dir, moved, removed, &junk) {
+				break
+			}
+			if err := e.removeLeftovers(dir, junk); err != nil {
+				log.WithFields(log.Fields{"folder": dir, "error": err}).Errorln("Could not clean up source folder")
+				break
+			}
+			removed[dir] = true
+		}
+	}
+}
+
+// onlyJunk returns whether dir contains nothing but junk, moved files and folders that were
+// removed already. The junk found is appended to junk.
+func (e *App) onlyJunk(dir string, moved, removed map[string]bool, junk *[]string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	var found []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case moved[path] || removed[path]:
+		case entry.IsDir() && isJunk(e.junk, entry.Name(), true):
+			found = append(found, path)
+		case entry.IsDir() && !isSymlink(entry):
+			if !e.onlyJunk(path, moved, removed, &found) {
+				return false
+			}
+			found = append(found, path)
+		case !entry.IsDir() && isJunk(e.junk, entry.Name(), false):
+			found = append(found, path)
+		default:
+			return false
+		}
+	}
+	*junk = append(*junk, found...)
+	return true
+}
+
+func isSymlink(entry os.DirEntry) bool {
+	return entry.Type()&os.ModeSymlink != 0
+}
+
+// removeLeftovers removes the junk and then the folder itself. Only folders on the junk list are
+// removed with their contents, other folders only when they are empty.
+func (e *App) removeLeftovers(dir string, junk []string) error {
+	dryRun := e.mode == "dry-run"
+	for _, path := range junk {
+		if dryRun {
+			log.WithFields(log.Fields{"path": path}).Infoln("DRY-RUN: Would remove leftover")
+			continue
+		}
+		log.WithFields(log.Fields{"path": path}).Infoln("Removing leftover")
+		remove := os.RemoveAll
+		if info, err := os.Lstat(path); err == nil && info.IsDir() && !isJunk(e.junk, info.Name(), true) {
+			remove = os.Remove
+		}
+		if err := remove(path); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		log.WithFields(log.Fields{"folder": dir}).Infoln("DRY-RUN: Would remove source folder")
+		return nil
+	}
+	log.WithFields(log.Fields{"folder": dir}).Infoln("Removing source folder")
+	// Remove and not RemoveAll, anything that appeared in the meantime is kept.
+	return os.Remove(dir)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// collisionPolicies are the valid values of --on-collision.
+var collisionPolicies = []string{"largest", "quality", "first", "ask"}
+
+func validCollisionPolicy(policy string) bool {
+	for _, p := range collisionPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveCollisions finds operations in the plan that have the same target, like a sample and
+// the main feature or two encodes of one episode. One operation of every group is kept using
+// the --on-collision policy, the others are skipped.
+func (e *App) resolveCollisions(operations []PlannedOperation) {
+	for _, group := range e.collisionGroups(operations) {
+		if len(group) < 2 {
+			continue
+		}
+		winner := e.collisionWinner(operations, group)
+		markCollisions(operations, group)
+		for _, i := range group {
+			if i != winner {
+				operations[i].Skip, operations[i].Lost = true, true
+			}
+		}
+		log.WithFields(log.Fields{"target": operations[winner].TargetPath, "files": len(group), "kept": operations[winner].SourcePath, "onCollision": e.onCollision}).Warnln("Several files have the same target, keeping one of them")
+	}
+}
+
+// collisionGroups groups the operations by target, in the order of the plan.
+func (e *App) collisionGroups(operations []PlannedOperation) [][]int {
+	groups := make(map[string][]int)
+	var order []string
+	for i, op := range operations {
+		key := e.targetKey(op.TargetPath)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	result := make([][]int, 0, len(order))
+	for _, key := range order {
+		result = append(result, groups[key])
+	}
+	return result
+}
+
+// targetKey is the key of a target when looking for collisions. Names that only differ in case
+// are the same file on a case-insensitive filesystem.
+func (e *App) targetKey(path string) string {
+	key := filepath.Clean(path)
+	if identify.SanitizeProfiles[e.sanitize].CaseInsensitive {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// markCollisions lets every operation of the group know which files it collides with.
+func markCollisions(operations []PlannedOperation, group []int) {
+	for _, i := range group {
+		for _, j := range group {
+			if i != j {
+				operations[i].CollidesWith = append(operations[i].CollidesWith, operations[j].SourcePath)
+			}
+		}
+	}
+}
+
+// selectOperation selects an operation the user picked. Only one file can end up at a target,
+// so the operations it collides with are skipped.
+func (e *App) selectOperation(operations []PlannedOperation, i int) {
+	operations[i].Skip, operations[i].Lost = false, false
+	for j := range operations {
+		if j != i && e.targetKey(operations[j].TargetPath) == e.targetKey(operations[i].TargetPath) {
+			operations[j].Skip, operations[j].Lost = true, true
+		}
+	}
+}
+
+// selectOperations selects operations in bulk. Collision losers stay skipped, they are only
+// selected when the user picks them with selectOperation.
+func selectOperations(operations []PlannedOperation, indexes []int) {
+	for _, i := range indexes {
+		if !operations[i].Lost {
+			operations[i].Skip = false
+		}
+	}
+}
+
+// updateCollisions resolves the collisions again after the user changed the target of an
+// operation. The edited operation is kept in the group it joined, files that lost a collision
+// and no longer collide are selected again, and a group that lost its kept file gets a new one.
+func (e *App) updateCollisions(operations []PlannedOperation, edited int) {
+	lost := make([]bool, len(operations))
+	for i := range operations {
+		lost[i] = operations[i].Lost
+		operations[i].CollidesWith, operations[i].Lost = nil, false
+	}
+
+	for _, group := range e.collisionGroups(operations) {
+		if len(group) < 2 {
+			if lost[group[0]] {
+				operations[group[0]].Skip = false
+			}
+			continue
+		}
+		markCollisions(operations, group)
+
+		orphaned := true
+		for _, i := range group {
+			operations[i].Lost = lost[i]
+			orphaned = orphaned && lost[i] && i != edited
+		}
+		// Asking in the middle of a review would be confusing, the user picks one instead.
+		if orphaned && e.onCollision != "ask" {
+			winner := e.collisionWinner(operations, group)
+			operations[winner].Skip, operations[winner].Lost = false, false
+		}
+	}
+	if !operations[edited].Skip {
+		e.selectOperation(operations, edited)
+	}
+}
+
+// collisionWinner returns the index of the operation to keep out of the colliding group.
+func (e *App) collisionWinner(operations []PlannedOperation, group []int) int {
+	switch e.onCollision {
+	case "first":
+		return group[0]
+	case "ask":
+		return promptForCollision(operations, group)
+	}
+
+	winner := group[0]
+	for _, i := range group[1:] {
+		better := 0
+		if e.onCollision == "quality" {
+			better = e.qualityRanking.Compare(operations[i].File, operations[winner].File)
+		}
+		if better == 0 {
+			better = compareSizes(operations[i].SourcePath, operations[winner].SourcePath)
+		}
+		if better > 0 {
+			winner = i
+		}
+	}
+	return winner
+}
+
+// compareSizes returns 1 when a is larger than b, -1 when it is smaller and 0 otherwise.
+func compareSizes(a, b string) int {
+	sizeA, sizeB := fileSize(a), fileSize(b)
+	if sizeA > sizeB {
+		return 1
+	} else if sizeA < sizeB {
+		return -1
+	}
+	return 0
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// promptForCollision lets the user pick the file to keep, the first file is kept when the
+// answer is not understood.
+func promptForCollision(operations []PlannedOperation, group []int) int {
+	fmt.Printf("\n%d files would end up as %s:\n", len(group), operations[group[0]].TargetPath)
+	for n, i := range group {
+		file := operations[i].File
+		fmt.Printf("  %d. %s (%d MB%s)\n", n+1, operations[i].SourcePath, fileSize(operations[i].SourcePath)/1024/1024, qualityDescription(file))
+	}
+	fmt.Printf("Which file do you want to keep? (1-%d, default 1): ", len(group))
+
+	response, err := stdin.ReadString('\n')
+	if err != nil {
+		log.WithError(err).Errorln("Error reading user input")
+		return group[0]
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(response))
+	if err != nil || n < 1 || n > len(group) {
+		return group[0]
+	}
+	return group[n-1]
+}
+
+// qualityDescription lists the known quality properties of a file, like ", 1080p BluRay".
+func qualityDescription(file identify.ParsedFile) string {
+	var parts []string
+	for _, p := range []string{file.Resolution, file.Quality, file.Codec} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(parts, " ")
+}
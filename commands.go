@@ -0,0 +1,263 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// command is a subcommand that can be given after the global flags, for example
+// `olaris-rename import-titles movies.json`.
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"format": {
+		usage:       "format preview [-lookup] [path]",
+		description: "Show how the configured formats (see --movie-format, --series-format and --preset) rename the built-in sample names or the files in path, without touching anything.",
+		run:         runFormat,
+	},
+	"undo": {
+		usage:       "undo [-list] [-dry-run] [run]",
+		description: "Reverse the operations of the last run, or of the given run, using the journal in the config folder.",
+		run:         runUndo,
+	},
+	"apply": {
+		usage:       "apply [-dry-run] <plan.json>",
+		description: "Execute a plan written by a dry-run with --plan-out. Operations whose source is gone or changed since the plan was made are refused.",
+		run:         runApply,
+	},
+	"import-titles": {
+		usage:       "import-titles [-type movie|tv] <file>...",
+		description: "Import or refresh titles in the local title database used by --provider=local.",
+		run:         runImportTitles,
+	},
+}
+
+// runCommand runs the given subcommand, it returns false when the command is unknown.
+func runCommand(args []string) bool {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	if err := cmd.run(args[1:]); err != nil {
+		log.WithError(err).Errorf("%s failed", args[0])
+		os.Exit(1)
+	}
+	return true
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n    \t%s\n", commands[name].usage, commands[name].description)
+	}
+}
+
+func titleDBPath() string {
+	return configFolderPath("titles.json")
+}
+
+func runImportTitles(args []string) error {
+	fs := flag.NewFlagSet("import-titles", flag.ExitOnError)
+	contentType := fs.String("type", "", "Type of the imported titles (movie or tv), only needed when the file does not say so itself.")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no files given to import")
+	}
+	if *contentType != "" && *contentType != identify.MovieType && *contentType != identify.SeriesType {
+		return fmt.Errorf("unknown type '%s', valid options are movie and tv", *contentType)
+	}
+
+	db, err := identify.OpenLocalDB(titleDBPath())
+	if os.IsNotExist(err) {
+		db = &identify.LocalDB{}
+	} else if err != nil {
+		return err
+	}
+
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		n, err := db.Import(f, *contentType)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not import '%s': %s", path, err)
+		}
+		log.WithFields(log.Fields{"file": path, "titles": n}).Infoln("Imported titles")
+	}
+
+	log.WithFields(log.Fields{"movies": len(db.Movies), "series": len(db.Series), "path": titleDBPath()}).Infoln("Saving local title database")
+	return db.Save(titleDBPath())
+}
+
+func runFormat(args []string) error {
+	if len(args) == 0 || args[0] != "preview" {
+		return fmt.Errorf("unknown format command, expected 'format preview'")
+	}
+
+	fs := flag.NewFlagSet("format preview", flag.ExitOnError)
+	lookup := fs.Bool("lookup", false, "Look up titles on TMDB, the result is closer to a real run but slower.")
+	fs.Parse(args[1:])
+
+	if err := resolveFormats(); err != nil {
+		log.Errorln(err)
+		printFormatPointer(err)
+		os.Exit(1)
+	}
+	replacements, err := identify.ParseReplacements(*sanitizeReplace)
+	if err != nil {
+		return err
+	}
+
+	names := identify.SampleNames
+	if fs.NArg() > 0 {
+		names, err = previewFiles(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+	}
+
+	opts := identify.Options{
+		Lookup:         *lookup,
+		MovieFormat:    *movieFormat,
+		SeriesFormat:   *seriesFormat,
+		SpecialsFormat: *specialsFormat,
+		ExtrasFormat:   *extrasFormat,
+		Language:       *language,
+		Sanitize:       *sanitize,
+		Replacements:   replacements,
+	}
+	for _, name := range names {
+		f := identify.NewParsedFile(name, opts)
+		fmt.Printf("%s\n  -> %s\n", name, f.TargetName())
+	}
+	return nil
+}
+
+// previewFiles returns the video files in path, path itself when it is a file.
+func previewFiles(path string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && identify.SupportedVideoExtensions[strings.ToLower(filepath.Ext(p))] {
+			files = append(files, p)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func runUndo(args []string) error {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	list := fs.Bool("list", false, "List the runs in the journal instead of undoing one.")
+	dryRun := fs.Bool("dry-run", false, "Show what would be undone without touching any files.")
+	fs.Parse(args)
+
+	entries, err := readJournal(journalPath())
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no journal found at '%s', nothing to undo", journalPath())
+	} else if err != nil {
+		return err
+	}
+	runs := journalRuns(entries)
+
+	if *list {
+		for _, run := range runs {
+			status := ""
+			if run.Undone {
+				status = " (undone)"
+			}
+			fmt.Printf("%s  %d operation(s)%s\n", run.ID, len(run.Operations), status)
+		}
+		return nil
+	}
+
+	var run *journalRun
+	if fs.NArg() > 0 {
+		for _, r := range runs {
+			if r.ID == fs.Arg(0) {
+				run = r
+			}
+		}
+		if run == nil {
+			return fmt.Errorf("run '%s' not found in the journal, see undo -list", fs.Arg(0))
+		}
+		if run.Undone {
+			return fmt.Errorf("run '%s' was already undone", run.ID)
+		}
+	} else {
+		for i := len(runs) - 1; i >= 0; i-- {
+			if !runs[i].Undone && len(runs[i].Operations) > 0 {
+				run = runs[i]
+				break
+			}
+		}
+		if run == nil {
+			return fmt.Errorf("no run left to undo")
+		}
+	}
+
+	log.WithFields(log.Fields{"run": run.ID, "operations": len(run.Operations)}).Infoln("Undoing run")
+	return undoRun(run, newJournal(journalPath()), *dryRun)
+}
+
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show what the plan would do without touching any files.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single plan file, usage: apply [-dry-run] <plan.json>")
+	}
+
+	if err := validateExecutionFlags(); err != nil {
+		return err
+	}
+	plan, err := readPlan(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+
+	mode := "force"
+	if *dryRun {
+		mode = "dry-run"
+	}
+	e := NewApp(false, plan.Action, *movieFolder, *seriesFolder, mode, false, "0", false, false)
+	configureExecution(e, cfg)
+
+	log.WithFields(log.Fields{"plan": fs.Arg(0), "operations": len(plan.Operations)}).Infoln("Applying plan")
+	operations, refused := e.applyPlan(plan)
+	if len(operations) > 0 {
+		log.WithFields(log.Fields{"files": len(operations), "results": summarizeResults(operations)}).Infoln("Done processing files")
+	}
+	if refused > 0 {
+		return fmt.Errorf("refused %d outdated operation(s) of the plan", refused)
+	}
+	return nil
+}
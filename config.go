@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// Config is the optional configuration file in the config folder, it holds settings that
+// don't fit on the command line.
+type Config struct {
+	// Overrides change how specific shows, movies or source folders are named, the first
+	// matching override is used.
+	Overrides []Override `json:"overrides"`
+	// QualityRanking is used by --upgrade to decide which release is better.
+	QualityRanking identify.QualityRanking `json:"quality_ranking"`
+	// CleanupJunk lists the leftovers --cleanup may remove, DefaultJunk is used when it is
+	// not set.
+	CleanupJunk []string `json:"cleanup_junk"`
+	// Hooks run commands or webhooks after every operation and at the end of a run.
+	Hooks []Hook `json:"hooks"`
+	// MediaServers are asked to refresh the folders files were put in after a run.
+	MediaServers []MediaServer `json:"media_servers"`
+}
+
+// Override changes the formats, target folder or episode numbering for the files it matches.
+// Files match on the show or movie name, the TMDB ID or the folder they are in, when more than
+// one of those is given all of them have to match.
+type Override struct {
+	Name   string `json:"name,omitempty"`
+	TmdbID int    `json:"tmdb_id,omitempty"`
+	Folder string `json:"folder,omitempty"`
+
+	MovieFormat    string `json:"movie_format,omitempty"`
+	SeriesFormat   string `json:"series_format,omitempty"`
+	SpecialsFormat string `json:"specials_format,omitempty"`
+	TargetFolder   string `json:"target_folder,omitempty"`
+
+	// Season replaces the parsed season, for example to put anime numbered by absolute episode
+	// in season 1. SeasonOffset and EpisodeOffset are added to the parsed numbers.
+	Season        *int `json:"season,omitempty"`
+	SeasonOffset  int  `json:"season_offset,omitempty"`
+	EpisodeOffset int  `json:"episode_offset,omitempty"`
+}
+
+func defaultConfigPath() string {
+	return configFolderPath("config.json")
+}
+
+// loadConfig reads the configuration file, a missing file is only an error when it was
+// given explicitly.
+func loadConfig(path string, explicit bool) (*Config, error) {
+	cfg := &Config{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("could not read config '%s': %s", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if err := validateJunk(c.CleanupJunk); err != nil {
+		return err
+	}
+	for i := range c.MediaServers {
+		if err := c.MediaServers[i].validate(); err != nil {
+			return fmt.Errorf("media server %d: %w", i+1, err)
+		}
+	}
+	for i := range c.Hooks {
+		if err := c.Hooks[i].validate(); err != nil {
+			return fmt.Errorf("hook %d: %w", i+1, err)
+		}
+	}
+	for i, o := range c.Overrides {
+		if o.Name == "" && o.TmdbID == 0 && o.Folder == "" {
+			return fmt.Errorf("override %d needs a name, tmdb_id or folder to match on", i+1)
+		}
+		for name, format := range map[string]string{"movie_format": o.MovieFormat, "series_format": o.SeriesFormat, "specials_format": o.SpecialsFormat} {
+			if format == "" {
+				continue
+			}
+			if _, err := identify.ParseFormat(format); err != nil {
+				return fmt.Errorf("override %d has an invalid %s: %w", i+1, name, err)
+			}
+		}
+		if o.Folder != "" {
+			abs, err := filepath.Abs(o.Folder)
+			if err != nil {
+				return err
+			}
+			c.Overrides[i].Folder = abs
+		}
+	}
+	return nil
+}
+
+// matches returns whether the override applies to the given file.
+func (o *Override) matches(file identify.ParsedFile) bool {
+	if o.TmdbID != 0 && o.TmdbID != file.ExternalID {
+		return false
+	}
+	if o.Name != "" && !strings.EqualFold(o.Name, file.CleanName) && !strings.EqualFold(o.Name, file.ExternalName) && !strings.EqualFold(o.Name, file.OriginalTitle) {
+		return false
+	}
+	if o.Folder != "" {
+		source, err := filepath.Abs(file.SourcePath())
+		if err != nil || !strings.HasPrefix(source, o.Folder+string(filepath.Separator)) {
+			return false
+		}
+	}
+	return true
+}
+
+// overrideFor returns the first override matching the file.
+func (e *App) overrideFor(file identify.ParsedFile) *Override {
+	for i := range e.overrides {
+		if e.overrides[i].matches(file) {
+			return &e.overrides[i]
+		}
+	}
+	return nil
+}
+
+// applyOverride changes the formats and episode numbering of a freshly identified file
+// according to the matching override.
+func (e *App) applyOverride(file *identify.ParsedFile, logger log.FieldLogger) error {
+	o := e.overrideFor(*file)
+	if o == nil {
+		return nil
+	}
+	logger.WithFields(log.Fields{"file": file.Filename, "name": o.Name, "tmdbID": o.TmdbID, "folder": o.Folder}).Debugln("Applying override")
+
+	if o.MovieFormat != "" {
+		file.Options.MovieFormat = o.MovieFormat
+	}
+	if o.SeriesFormat != "" {
+		file.Options.SeriesFormat = o.SeriesFormat
+	}
+	if o.SpecialsFormat != "" {
+		file.Options.SpecialsFormat = o.SpecialsFormat
+	}
+
+	if file.IsSeries {
+		season, episode := file.Season, file.Episode
+		if o.Season != nil {
+			file.Season = fmt.Sprintf("%02d", *o.Season)
+		}
+		file.Season = offsetNumber(file.Season, o.SeasonOffset)
+		file.Episode = offsetNumber(file.Episode, o.EpisodeOffset)
+		// The episode name was looked up for the old numbering.
+		if file.Season != season || file.Episode != episode {
+			if err := file.LookupEpisodeName(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The new formats might use tokens that need more information from TMDB.
+	return file.LookupDetails()
+}
+
+// offsetNumber adds offset to a zero padded number.
+func offsetNumber(v string, offset int) string {
+	n, err := strconv.Atoi(v)
+	if offset == 0 || err != nil {
+		return v
+	}
+	if n+offset < 0 {
+		return v
+	}
+	return fmt.Sprintf("%0*d", len(v), n+offset)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Results of an operation.
+const (
+	resultDone        = "done"
+	resultSkipped     = "skipped"
+	resultOverwritten = "overwritten"
+	resultSuffixed    = "suffixed"
+	resultUpgraded    = "upgraded"
+	resultFailed      = "failed"
+)
+
+// placed returns whether the result means the file was put at its target.
+func placed(result string) bool {
+	switch result {
+	case resultDone, resultOverwritten, resultSuffixed, resultUpgraded:
+		return true
+	}
+	return false
+}
+
+// conflictPolicies are the valid values of --on-conflict.
+var conflictPolicies = []string{"skip", "overwrite", "suffix", "keep-larger", "keep-newer", "fail"}
+
+func validConflictPolicy(policy string) bool {
+	for _, p := range conflictPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// targetConflicts returns whether target exists and is not the source itself.
+func targetConflicts(source, target string) bool {
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return false
+	}
+	if sourceInfo, err := os.Lstat(source); err == nil && os.SameFile(sourceInfo, targetInfo) {
+		return false
+	}
+	return true
+}
+
+// resolveConflict decides what to do with source when target exists, it returns resultDone
+// when there is no conflict at all.
+func resolveConflict(policy, source, target string) (string, error) {
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return resultDone, nil
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return resultFailed, err
+	}
+	if os.SameFile(sourceInfo, targetInfo) {
+		// Renaming a file to its own name, or a hardlink that is already there.
+		return resultSkipped, nil
+	}
+	if targetInfo.IsDir() {
+		return resultFailed, fmt.Errorf("target '%s' is a directory", target)
+	}
+
+	switch policy {
+	case "overwrite":
+		return resultOverwritten, nil
+	case "suffix":
+		return resultSuffixed, nil
+	case "keep-larger":
+		if sourceInfo.Size() > targetInfo.Size() {
+			return resultOverwritten, nil
+		}
+		return resultSkipped, nil
+	case "keep-newer":
+		if sourceInfo.ModTime().After(targetInfo.ModTime()) {
+			return resultOverwritten, nil
+		}
+		return resultSkipped, nil
+	case "fail":
+		return resultFailed, fmt.Errorf("target '%s' already exists", target)
+	}
+	return resultSkipped, nil
+}
+
+// summarizeResults counts the results of executed operations, for example "3 done, 1 skipped".
+func summarizeResults(operations []PlannedOperation) string {
+	counts := make(map[string]int)
+	for _, op := range operations {
+		counts[op.Result]++
+	}
+	var parts []string
+	for _, result := range []string{resultDone, resultUpgraded, resultOverwritten, resultSuffixed, resultSkipped, resultFailed} {
+		if counts[result] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[result], result))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// suffixedTarget returns the first free name like "Movie (1).mkv" next to target.
+func suffixedTarget(target string) string {
+	ext := filepath.Ext(target)
+	base := strings.TrimSuffix(target, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
@@ -9,14 +9,33 @@ import (
 var recursive = flag.Bool("recursive", true, "Scan folders inside of other folders.")
 var logToFile = flag.Bool("log-to-file", false, "Logs are written to stdout as well as a logfile.")
 var verbose = flag.Bool("verbose", false, "Show debug log information.")
-var mode = flag.String("mode", "interactive", "Operating mode: dry-run (show what would be done), interactive (ask for confirmation), or force (execute without confirmation).")
-var action = flag.String("action", "rename", "How to act on files, valid options are rename, symlink, hardlink, copy or move.")
+var mode = flag.String("mode", "interactive", "Operating mode: dry-run (show what would be done), interactive (review every file before anything happens), tui (review the plan in a full-screen view) or force (execute without confirmation).")
+var action = flag.String("action", "rename", "How to act on files, valid options are rename, symlink, hardlink, copy, reflink or move.")
+var onConflict = flag.String("on-conflict", "skip", "What to do when the target already exists: skip, overwrite, suffix (add a number), keep-larger, keep-newer or fail.")
+var upgrade = flag.Bool("upgrade", false, "Replace worse releases of the same movie or episode in the library, files that are not an upgrade are skipped. The ranking can be changed in the config file.")
+var trashFolder = flag.String("trash-folder", "", "Folder replaced files are moved to by --upgrade and --on-conflict. Defaults to trash in the config folder.")
+var reflinkFallback = flag.String("reflink-fallback", "copy", "Action used by --action=reflink when the filesystem doesn't support reflinks: copy, hardlink or none.")
+var onCollision = flag.String("on-collision", "largest", "Which file to keep when several files in a run have the same target: largest, quality (then largest), first or ask (interactive mode only).")
+var cleanup = flag.Bool("cleanup", false, "After moving files, remove source folders that only contain leftovers like .nfo files and samples. The list can be changed in the config file.")
+var planOut = flag.String("plan-out", "", "Write the planned operations of a dry-run to this file, the apply command executes them later.")
+var verifyCopies = flag.Bool("verify-copies", false, "Compare checksums of source and copy before a copied file gets its final name.")
 var filePath = flag.String("filepath", ".", "Path to scan (can be a folder or file).")
 var movieFolder = flag.String("movie-folder", defaultMovieFolder(), "Folder where movies should be placed.")
 var seriesFolder = flag.String("series-folder", defaultSeriesFolder(), "Folder where series should be placed.")
-var tmdbLookup = flag.Bool("tmdb-lookup", true, "Should the TMDB be used for better look-up and matching.")
+var tmdbLookup = flag.Bool("tmdb-lookup", true, "Should titles be looked up (see --provider) for better matching.")
 var minFileSize = flag.String("min-file-size", "120", "Minimal file size in MB for olaris-rename to consider a file valid to be processed.")
 var seriesFormat = flag.String("series-format", identify.DefaultSeriesFormat, "Format used to rename series.")
 var movieFormat = flag.String("movie-format", identify.DefaultMovieFormat, "Format used to rename movies.")
+var specialsFormat = flag.String("specials-format", "", "Format used to rename specials (season 0), --series-format is used when empty.")
+var extrasFormat = flag.String("extras-format", "", "Format used to rename movie extras like trailers, they are treated like any other movie file when empty.")
+var preset = flag.String("preset", "", "Naming preset for a media server: plex, jellyfin, emby or kodi. Formats given with the format flags take precedence.")
 var forceMovie = flag.Bool("force-movie", false, "Forces the supplied path to be identified as a movie.")
 var forceSeries = flag.Bool("force-series", false, "Forces the supplied path to be identified as a series.")
+var language = flag.String("language", "", "Language used for TMDB titles and episode names, for example de-DE. Uses the TMDB default when empty.")
+var fallbackLanguage = flag.String("fallback-language", "", "Language used for TMDB titles and episode names when nothing is available in --language.")
+var tmdbRateLimit = flag.Float64("tmdb-rate-limit", identify.DefaultClientOptions().RequestsPerSecond, "Maximum amount of TMDB requests per second.")
+var jobs = flag.Int("jobs", 4, "Amount of files that are identified concurrently, mostly useful together with --tmdb-lookup.")
+var provider = flag.String("provider", "tmdb", "Where lookups are done: tmdb (online) or local (the title database imported with import-titles).")
+var configPath = flag.String("config", "", "Configuration file with overrides for specific shows, movies or folders. Defaults to config.json in the config folder.")
+var sanitize = flag.String("sanitize", identify.DefaultSanitizeProfile, "Which filesystem names have to be valid for: posix, windows, smb or fat32.")
+var sanitizeReplace = flag.String("sanitize-replace", "", "Comma separated list of replacements applied to names before sanitizing, for example ':= -,&=and'.")
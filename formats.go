@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// formatFlags are the flags holding formats, in the order they are validated.
+var formatFlags = []struct {
+	name   string
+	format *string
+}{
+	{"movie-format", movieFormat},
+	{"series-format", seriesFormat},
+	{"specials-format", specialsFormat},
+	{"extras-format", extrasFormat},
+}
+
+// resolveFormats applies --preset to the format flags that were not given explicitly and
+// validates the resulting formats, so typos are caught before any file is touched.
+func resolveFormats() error {
+	if *preset != "" {
+		p, ok := identify.Presets[*preset]
+		if !ok {
+			return fmt.Errorf("unknown --preset '%s', valid options are: %s", *preset, strings.Join(identify.PresetNames(), ", "))
+		}
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		presetFormats := map[string]string{
+			"movie-format":    p.MovieFormat,
+			"series-format":   p.SeriesFormat,
+			"specials-format": p.SpecialsFormat,
+			"extras-format":   p.ExtrasFormat,
+		}
+		// Formats given on the command line take precedence over the preset.
+		for _, f := range formatFlags {
+			if !set[f.name] {
+				*f.format = presetFormats[f.name]
+			}
+		}
+		log.WithFields(log.Fields{"preset": *preset}).Infoln("Using naming preset")
+	}
+
+	for _, f := range formatFlags {
+		if *f.format == "" {
+			continue
+		}
+		if _, err := identify.ParseFormat(*f.format); err != nil {
+			return fmt.Errorf("invalid --%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// printFormatPointer points at the offending position of a format error.
+func printFormatPointer(err error) {
+	var fe *identify.FormatError
+	if errors.As(err, &fe) {
+		fmt.Fprintf(os.Stderr, "  %s\n  %s^\n", fe.Format, strings.Repeat(" ", utf8.RuneCountInString(fe.Format[:fe.Position])))
+	}
+}
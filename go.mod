@@ -5,12 +5,12 @@ go 1.18
 require (
 	github.com/ryanbradynd05/go-tmdb v0.0.0-20190901200645-e8dd22863620
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/sys v0.0.0-20190422165155-953cdadca894
 	golang.org/x/text v0.3.7
 )
 
 require (
 	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
 	github.com/kylelemons/go-gypsy v1.0.0 // indirect
-	golang.org/x/sys v0.0.0-20190422165155-953cdadca894 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
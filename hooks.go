@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// Hook events.
+const (
+	// hookOperation runs after every file that was put at its target.
+	hookOperation = "operation"
+	// hookRun runs once at the end of a run.
+	hookRun = "run"
+)
+
+// defaultHookTimeout is used for hooks without a timeout.
+const defaultHookTimeout = 30 * time.Second
+
+// hookFailurePolicies are the valid values of on_failure, warn is the default.
+var hookFailurePolicies = map[string]bool{
+	"ignore": true,
+	"warn":   true,
+	"abort":  true,
+}
+
+// Hook runs a command or posts to a webhook after operations or at the end of a run, the JSON
+// payload is passed on stdin to commands.
+type Hook struct {
+	Event   string            `json:"event"`
+	Command []string          `json:"command,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout is a duration like "30s", the hook is stopped when it takes longer.
+	Timeout string `json:"timeout,omitempty"`
+	// OnFailure decides what happens when the hook fails: ignore, warn or abort the run.
+	OnFailure string `json:"on_failure,omitempty"`
+
+	timeout time.Duration
+}
+
+func (h *Hook) validate() error {
+	if h.Event != hookOperation && h.Event != hookRun {
+		return fmt.Errorf("unknown event '%s', valid events are operation and run", h.Event)
+	}
+	if (len(h.Command) == 0) == (h.URL == "") {
+		return fmt.Errorf("needs either a command or a url")
+	}
+	if h.OnFailure == "" {
+		h.OnFailure = "warn"
+	}
+	if !hookFailurePolicies[h.OnFailure] {
+		return fmt.Errorf("unknown on_failure '%s', valid options are ignore, warn and abort", h.OnFailure)
+	}
+	h.timeout = defaultHookTimeout
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout '%s'", h.Timeout)
+		}
+		h.timeout = timeout
+	}
+	return nil
+}
+
+func (h *Hook) String() string {
+	if h.URL != "" {
+		return h.URL
+	}
+	return strings.Join(h.Command, " ")
+}
+
+// hookPayload is sent to the hooks of an operation.
+type hookPayload struct {
+	Event  string    `json:"event"`
+	Source string    `json:"source"`
+	Target string    `json:"target"`
+	Action string    `json:"action"`
+	Result string    `json:"result"`
+	File   *hookFile `json:"file"`
+}
+
+// hookFile holds the identified fields of a file.
+type hookFile struct {
+	Name          string   `json:"name"`
+	OriginalTitle string   `json:"original_title,omitempty"`
+	Year          string   `json:"year,omitempty"`
+	Season        string   `json:"season,omitempty"`
+	Episode       string   `json:"episode,omitempty"`
+	EpisodeName   string   `json:"episode_name,omitempty"`
+	IsMovie       bool     `json:"is_movie"`
+	IsSeries      bool     `json:"is_series"`
+	Resolution    string   `json:"resolution,omitempty"`
+	Quality       string   `json:"quality,omitempty"`
+	Codec         string   `json:"codec,omitempty"`
+	Group         string   `json:"group,omitempty"`
+	ExtraType     string   `json:"extra_type,omitempty"`
+	TmdbID        int      `json:"tmdb_id,omitempty"`
+	ImdbID        string   `json:"imdb_id,omitempty"`
+	TvdbID        int      `json:"tvdb_id,omitempty"`
+	Genres        []string `json:"genres,omitempty"`
+	Collection    string   `json:"collection,omitempty"`
+	Certification string   `json:"certification,omitempty"`
+	Country       string   `json:"country,omitempty"`
+}
+
+func newHookFile(file identify.ParsedFile) *hookFile {
+	return &hookFile{
+		Name:          file.CleanName,
+		OriginalTitle: file.OriginalTitle,
+		Year:          file.Year,
+		Season:        file.Season,
+		Episode:       file.Episode,
+		EpisodeName:   file.EpisodeName,
+		IsMovie:       file.IsMovie,
+		IsSeries:      file.IsSeries,
+		Resolution:    file.Resolution,
+		Quality:       file.Quality,
+		Codec:         file.Codec,
+		Group:         file.Group,
+		ExtraType:     file.ExtraType,
+		TmdbID:        file.ExternalID,
+		ImdbID:        file.ImdbID,
+		TvdbID:        file.TvdbID,
+		Genres:        file.Genres,
+		Collection:    file.Collection,
+		Certification: file.Certification,
+		Country:       file.Country,
+	}
+}
+
+// runHookPayload is sent to the hooks at the end of a run.
+type runHookPayload struct {
+	Event      string         `json:"event"`
+	Action     string         `json:"action"`
+	Results    map[string]int `json:"results"`
+	Operations []hookPayload  `json:"operations"`
+}
+
+func newOperationPayload(op PlannedOperation) hookPayload {
+	return hookPayload{
+		Event:  hookOperation,
+		Source: op.SourcePath,
+		Target: op.TargetPath,
+		Action: op.Action,
+		Result: op.Result,
+		File:   newHookFile(op.File),
+	}
+}
+
+func newRunPayload(action string, operations []PlannedOperation) runHookPayload {
+	payload := runHookPayload{Event: hookRun, Action: action, Results: make(map[string]int), Operations: []hookPayload{}}
+	for _, op := range operations {
+		payload.Results[op.Result]++
+		p := newOperationPayload(op)
+		p.File = nil
+		payload.Operations = append(payload.Operations, p)
+	}
+	return payload
+}
+
+// runHooks runs the hooks for the event one after another. It returns an error when a hook
+// with the abort policy failed, in dry-run mode the hooks are only logged.
+func (e *App) runHooks(event string, payload interface{}, env map[string]string) error {
+	var body []byte
+	for i := range e.hooks {
+		h := &e.hooks[i]
+		if h.Event != event {
+			continue
+		}
+		logger := log.WithFields(log.Fields{"event": event, "hook": h.String()})
+		if e.mode == "dry-run" {
+			logger.Infoln("DRY-RUN: Would run hook")
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(payload); err != nil {
+				return err
+			}
+		}
+		logger.Debugln("Running hook")
+		err := h.run(body, env)
+		if err == nil {
+			continue
+		}
+		switch h.OnFailure {
+		case "ignore":
+			logger.WithError(err).Debugln("Hook failed")
+		case "warn":
+			logger.WithError(err).Warnln("Hook failed")
+		case "abort":
+			logger.WithError(err).Errorln("Hook failed, aborting")
+			return fmt.Errorf("hook '%s' failed: %w", h, err)
+		}
+	}
+	return nil
+}
+
+func (h *Hook) run(body []byte, env map[string]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	if h.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range h.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// operationHookEnv are the environment variables of an operation hook command.
+func operationHookEnv(op PlannedOperation) map[string]string {
+	return map[string]string{
+		"OLARIS_EVENT":  hookOperation,
+		"OLARIS_SOURCE": op.SourcePath,
+		"OLARIS_TARGET": op.TargetPath,
+		"OLARIS_ACTION": op.Action,
+		"OLARIS_RESULT": op.Result,
+	}
+}
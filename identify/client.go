@@ -0,0 +1,429 @@
+package identify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryanbradynd05/go-tmdb"
+	log "github.com/sirupsen/logrus"
+)
+
+const tmdbBaseURL = "https://api.themoviedb.org/3"
+
+// ErrProviderUnavailable is returned when the metadata provider could not be reached, kept
+// failing after retries or when the circuit breaker is open.
+var ErrProviderUnavailable = errors.New("metadata provider unavailable")
+
+// ClientOptions configures the shared TMDB client.
+type ClientOptions struct {
+	APIKey  string
+	BaseURL string
+	// RequestsPerSecond is the steady rate of the token bucket, Burst the amount of tokens it holds.
+	RequestsPerSecond float64
+	Burst             int
+	// MaxRetries is the amount of retries for 429 and 5xx responses and connection errors,
+	// a negative value disables retries.
+	MaxRetries int
+	// Backoff is the initial wait between retries, it doubles on every attempt up to MaxBackoff.
+	// A negative value retries right away.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// BreakerThreshold is the amount of consecutive failed requests after which the breaker opens
+	// for BreakerCooldown, during which all requests fail fast.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	Timeout          time.Duration
+}
+
+// DefaultClientOptions returns the options used when the client is not configured explicitly.
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		APIKey:            tmdbAPIKey,
+		BaseURL:           tmdbBaseURL,
+		RequestsPerSecond: 10,
+		Burst:             10,
+		MaxRetries:        5,
+		Backoff:           500 * time.Millisecond,
+		MaxBackoff:        30 * time.Second,
+		BreakerThreshold:  5,
+		BreakerCooldown:   time.Minute,
+		Timeout:           30 * time.Second,
+	}
+}
+
+// Client is a TMDB client that is shared between all lookups so rate limiting and the circuit
+// breaker apply to the whole run. It is safe for concurrent use.
+type Client struct {
+	opts    ClientOptions
+	http    *http.Client
+	limiter *tokenBucket
+	breaker *circuitBreaker
+}
+
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("TMDB returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// decodeError is returned when a successful response could not be decoded, asking again won't
+// change the answer.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("could not decode TMDB response: %s", e.err)
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+var (
+	clientMu     sync.Mutex
+	sharedClient *Client
+)
+
+// NewClient creates a new TMDB client, zero values in opts are replaced by the defaults.
+func NewClient(opts ClientOptions) *Client {
+	def := DefaultClientOptions()
+	if opts.APIKey == "" {
+		opts.APIKey = def.APIKey
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = def.BaseURL
+	}
+	if opts.RequestsPerSecond <= 0 {
+		opts.RequestsPerSecond = def.RequestsPerSecond
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = def.Burst
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = def.MaxRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = def.Backoff
+	} else if opts.Backoff < 0 {
+		opts.Backoff = 0
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = def.MaxBackoff
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = def.BreakerThreshold
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = def.BreakerCooldown
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = def.Timeout
+	}
+
+	return &Client{
+		opts:    opts,
+		http:    &http.Client{Timeout: opts.Timeout},
+		limiter: newTokenBucket(opts.RequestsPerSecond, opts.Burst),
+		breaker: &circuitBreaker{threshold: opts.BreakerThreshold, cooldown: opts.BreakerCooldown},
+	}
+}
+
+// ConfigureClient replaces the shared client used for all lookups.
+func ConfigureClient(opts ClientOptions) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	sharedClient = NewClient(opts)
+}
+
+func initAgent() *Client {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if sharedClient == nil {
+		sharedClient = NewClient(DefaultClientOptions())
+	}
+	return sharedClient
+}
+
+// SearchTv searches for TV shows by name.
+func (c *Client) SearchTv(name string, options map[string]string) (*tmdb.TvSearchResults, error) {
+	var res tmdb.TvSearchResults
+	err := c.get("/search/tv", withQuery(name, options, "language", "first_air_date_year"), &res)
+	return &res, err
+}
+
+// SearchMovie searches for movies by title.
+func (c *Client) SearchMovie(name string, options map[string]string) (*tmdb.MovieSearchResults, error) {
+	var res tmdb.MovieSearchResults
+	err := c.get("/search/movie", withQuery(name, options, "language", "year"), &res)
+	return &res, err
+}
+
+// GetTvInfo fetches the details of a TV show.
+func (c *Client) GetTvInfo(id int, options map[string]string) (*tmdb.TV, error) {
+	var res tmdb.TV
+	err := c.get(fmt.Sprintf("/tv/%d", id), filterOptions(options, "language", "append_to_response"), &res)
+	return &res, err
+}
+
+// TvDetails are the details of a TV show, including the appended content ratings.
+type TvDetails struct {
+	tmdb.TV
+	ContentRatings *struct {
+		Results []struct {
+			Iso3166_1 string `json:"iso_3166_1"`
+			Rating    string `json:"rating"`
+		} `json:"results"`
+	} `json:"content_ratings,omitempty"`
+}
+
+// GetTvDetails fetches the details of a TV show, append_to_response can add content_ratings.
+func (c *Client) GetTvDetails(id int, options map[string]string) (*TvDetails, error) {
+	var res TvDetails
+	err := c.get(fmt.Sprintf("/tv/%d", id), filterOptions(options, "language", "append_to_response"), &res)
+	return &res, err
+}
+
+// GetTvEpisodeInfo fetches the details of a single episode.
+func (c *Client) GetTvEpisodeInfo(showID, seasonNum, episodeNum int, options map[string]string) (*tmdb.TvEpisode, error) {
+	var res tmdb.TvEpisode
+	err := c.get(fmt.Sprintf("/tv/%d/season/%d/episode/%d", showID, seasonNum, episodeNum), filterOptions(options, "language"), &res)
+	return &res, err
+}
+
+// GetMovieInfo fetches the details of a movie.
+func (c *Client) GetMovieInfo(id int, options map[string]string) (*tmdb.Movie, error) {
+	var res tmdb.Movie
+	err := c.get(fmt.Sprintf("/movie/%d", id), filterOptions(options, "language", "append_to_response"), &res)
+	return &res, err
+}
+
+// GetMovieExternalIDs fetches the IDs of a movie on other sites like IMDb.
+func (c *Client) GetMovieExternalIDs(id int) (*tmdb.MovieExternalIds, error) {
+	var res tmdb.MovieExternalIds
+	err := c.get(fmt.Sprintf("/movie/%d/external_ids", id), url.Values{}, &res)
+	return &res, err
+}
+
+// GetTvExternalIDs fetches the IDs of a TV show on other sites like IMDb and TheTVDB.
+func (c *Client) GetTvExternalIDs(id int) (*tmdb.TvExternalIds, error) {
+	var res tmdb.TvExternalIds
+	err := c.get(fmt.Sprintf("/tv/%d/external_ids", id), url.Values{}, &res)
+	return &res, err
+}
+
+func withQuery(name string, options map[string]string, allowed ...string) url.Values {
+	v := filterOptions(options, allowed...)
+	v.Set("query", name)
+	return v
+}
+
+func filterOptions(options map[string]string, allowed ...string) url.Values {
+	v := url.Values{}
+	for _, key := range allowed {
+		if val, ok := options[key]; ok && val != "" {
+			v.Set(key, val)
+		}
+	}
+	return v
+}
+
+// get performs a rate limited GET request, retrying on 429, 5xx and connection errors.
+func (c *Client) get(path string, query url.Values, payload interface{}) error {
+	if !c.breaker.allow() {
+		return fmt.Errorf("%w: circuit breaker is open", ErrProviderUnavailable)
+	}
+
+	query.Set("api_key", c.opts.APIKey)
+	uri := c.opts.BaseURL + path + "?" + query.Encode()
+
+	var lastErr error
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		c.limiter.wait()
+
+		wait, err := c.do(uri, payload)
+		if err == nil {
+			c.breaker.success()
+			return nil
+		}
+
+		var apiErr *apiError
+		var decodeErr *decodeError
+		if errors.As(err, &decodeErr) || (errors.As(err, &apiErr) && !retryable(apiErr.StatusCode)) {
+			// The provider answered, it just didn't like the request or sent something odd.
+			c.breaker.success()
+			return err
+		}
+
+		lastErr = err
+		if attempt == c.opts.MaxRetries {
+			break
+		}
+		if wait <= 0 {
+			wait = c.backoff(attempt)
+		} else if wait > c.opts.MaxBackoff {
+			// Don't let the server stall the run.
+			wait = c.opts.MaxBackoff
+		}
+		log.WithFields(log.Fields{"path": path, "attempt": attempt + 1, "wait": wait, "error": err}).Debugln("TMDB request failed, retrying")
+		time.Sleep(wait)
+	}
+
+	c.breaker.failure()
+	return fmt.Errorf("%w: %s", ErrProviderUnavailable, lastErr)
+}
+
+// do performs a single request, the returned duration is the Retry-After value if one was sent.
+func (c *Client) do(uri string, payload interface{}) (time.Duration, error) {
+	res, err := c.http.Get(uri)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		if err := json.Unmarshal(body, payload); err != nil {
+			return 0, &decodeError{err: err}
+		}
+		return 0, nil
+	}
+
+	var status struct {
+		Message string `json:"status_message"`
+	}
+	json.Unmarshal(body, &status)
+	if status.Message == "" {
+		status.Message = http.StatusText(res.StatusCode)
+	}
+
+	return retryAfter(res.Header.Get("Retry-After")), &apiError{StatusCode: res.StatusCode, Message: status.Message}
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	if c.opts.Backoff == 0 {
+		return 0
+	}
+	wait := c.opts.Backoff << uint(attempt)
+	if wait <= 0 || wait > c.opts.MaxBackoff {
+		wait = c.opts.MaxBackoff
+	}
+	return wait
+}
+
+func retryable(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// retryAfter parses a Retry-After header which is either in seconds or a HTTP date.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// IsUnavailable reports whether err means the metadata provider could not be used.
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrProviderUnavailable)
+}
+
+// tokenBucket is a simple token bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a token is available.
+func (b *tokenBucket) wait() {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// circuitBreaker stops requests for a while after too many consecutive failures. Once the
+// cooldown has passed a single request is let through to probe whether the provider is back.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.WithField("cooldown", b.cooldown).Warnln("TMDB keeps failing, pausing lookups")
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
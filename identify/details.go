@@ -0,0 +1,156 @@
+package identify
+
+import (
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// detailTokens need the full TMDB record of a title, it is only fetched when the format uses one
+// of them so plain renames don't cost an extra request per file.
+var detailTokens = []string{"genre", "collection", "country", "cert"}
+
+// externalIDTokens need the external IDs of a title, they come from a separate endpoint.
+var externalIDTokens = []string{"imdbid", "tvdbid"}
+
+// unknownGenre is used for {genre} when no genre is known, so files don't end up in the root.
+const unknownGenre = "Unknown"
+
+// defaultCertificationCountry is used for {cert} when the language has no region.
+const defaultCertificationCountry = "US"
+
+// queryDetails fetches genres, collection, certification, country and runtime from TMDB. Only
+// an unavailable provider is returned as error, the file can be named without the details otherwise.
+func queryDetails(p *ParsedFile, agent *Client) error {
+	logger := p.Options.logger()
+	options := map[string]string{}
+	if p.Options.Language != "" {
+		options["language"] = p.Options.Language
+	}
+	country := certificationCountry(p.Options.Language)
+
+	if p.IsSeries {
+		options["append_to_response"] = "content_ratings"
+		tv, err := agent.GetTvDetails(p.ExternalID, options)
+		if err != nil {
+			logger.WithFields(log.Fields{"externalID": p.ExternalID, "error": err}).Warnln("Could not fetch series details from TMDB")
+			if IsUnavailable(err) {
+				return err
+			}
+			return nil
+		}
+		for _, g := range tv.Genres {
+			p.Genres = append(p.Genres, g.Name)
+		}
+		if len(tv.OriginCountry) > 0 {
+			p.Country = tv.OriginCountry[0]
+		}
+		if len(tv.EpisodeRunTime) > 0 {
+			p.Runtime = tv.EpisodeRunTime[0]
+		}
+		if tv.ContentRatings != nil {
+			ratings := make(map[string]string)
+			for _, r := range tv.ContentRatings.Results {
+				ratings[r.Iso3166_1] = r.Rating
+			}
+			p.Certification = pickCertification(ratings, country)
+		}
+	} else if p.IsMovie {
+		options["append_to_response"] = "releases"
+		mov, err := agent.GetMovieInfo(p.ExternalID, options)
+		if err != nil {
+			logger.WithFields(log.Fields{"externalID": p.ExternalID, "error": err}).Warnln("Could not fetch movie details from TMDB")
+			if IsUnavailable(err) {
+				return err
+			}
+			return nil
+		}
+		for _, g := range mov.Genres {
+			p.Genres = append(p.Genres, g.Name)
+		}
+		p.Collection = mov.BelongsToCollection.Name
+		if len(mov.ProductionCountries) > 0 {
+			p.Country = mov.ProductionCountries[0].Iso3166_1
+		}
+		p.Runtime = int(mov.Runtime)
+		if mov.Releases != nil {
+			ratings := make(map[string]string)
+			for _, r := range mov.Releases.Countries {
+				if r.Certification != "" {
+					ratings[r.Iso3166_1] = r.Certification
+				}
+			}
+			p.Certification = pickCertification(ratings, country)
+		}
+	}
+
+	p.detailsFetched = true
+	logger.WithFields(log.Fields{"genres": p.Genres, "collection": p.Collection, "country": p.Country, "certification": p.Certification, "runtime": p.Runtime}).Debugln("Received TMDB details.")
+	return nil
+}
+
+// queryExternalIDs fetches the IMDb and TheTVDB IDs from TMDB. Like queryDetails only an
+// unavailable provider is returned as error.
+func queryExternalIDs(p *ParsedFile, agent *Client) error {
+	logger := p.Options.logger()
+
+	if p.IsSeries {
+		ids, err := agent.GetTvExternalIDs(p.ExternalID)
+		if err != nil {
+			logger.WithFields(log.Fields{"externalID": p.ExternalID, "error": err}).Warnln("Could not fetch external IDs from TMDB")
+			if IsUnavailable(err) {
+				return err
+			}
+			return nil
+		}
+		p.ImdbID = ids.ImdbID
+		p.TvdbID = ids.TvdbID
+	} else if p.IsMovie {
+		ids, err := agent.GetMovieExternalIDs(p.ExternalID)
+		if err != nil {
+			logger.WithFields(log.Fields{"externalID": p.ExternalID, "error": err}).Warnln("Could not fetch external IDs from TMDB")
+			if IsUnavailable(err) {
+				return err
+			}
+			return nil
+		}
+		p.ImdbID = ids.ImdbID
+	}
+
+	p.externalIDsFetched = true
+	logger.WithFields(log.Fields{"imdbID": p.ImdbID, "tvdbID": p.TvdbID}).Debugln("Received external IDs.")
+	return nil
+}
+
+// certificationCountry returns the region of a language like de-DE, certifications differ per country.
+func certificationCountry(language string) string {
+	if i := strings.IndexByte(language, '-'); i >= 0 && i+1 < len(language) {
+		return strings.ToUpper(language[i+1:])
+	}
+	return defaultCertificationCountry
+}
+
+// pickCertification prefers the certification of the given country, then the US one.
+func pickCertification(ratings map[string]string, country string) string {
+	if r := ratings[country]; r != "" {
+		return r
+	}
+	return ratings[defaultCertificationCountry]
+}
+
+// sortLetter returns the letter a name is sorted under, ignoring leading articles and accents.
+// Names starting with anything other than a letter are sorted under "#".
+func sortLetter(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	for _, r := range asciiName(sortName(name)) {
+		if unicode.IsLetter(r) {
+			return string(unicode.ToUpper(r))
+		}
+		break
+	}
+	return "#"
+}
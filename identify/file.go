@@ -7,10 +7,12 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 
+	"github.com/ryanbradynd05/go-tmdb"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,22 +22,46 @@ type ParsedFile struct {
 	Episode      string
 	EpisodeName  string
 	ExternalName string
+	OriginalTitle string
 	CleanName    string
 	Filepath     string
 	Filename     string
 	Extension    string
 	Quality      string
 	Resolution   string
+	Codec        string
+	// Proper and Repack mark fixed releases, they are preferred over the original release.
+	Proper bool
+	Repack bool
 	TechnicalInfo string
 	Group        string
 	AnimeGroup   string
 	IsSeries     bool
 	IsMovie      bool
+	// Genres, Collection, Certification, Country and Runtime (in minutes) come from the TMDB
+	// details, they are only looked up when the format uses them.
+	Genres        []string
+	Collection    string
+	Certification string
+	Country       string
+	Runtime       int
+	// ImdbID and TvdbID are only looked up when the format uses them.
+	ImdbID string
+	TvdbID int
+	// ExtraType is set for extras like trailers, it is the Plex name of the kind of extra.
+	ExtraType string
+	// LookupFailed is set when the metadata provider was unavailable, the name is probably degraded.
+	LookupFailed bool
 	ExternalID   int
 	OriginalFile string
 	Options      Options
 
 	hasYearAsSeason bool
+	// absoluteEpisode is set when the episode number is absolute, the season is unknown then.
+	absoluteEpisode bool
+	// detailsFetched and externalIDsFetched prevent fetching the same TMDB data twice.
+	detailsFetched     bool
+	externalIDsFetched bool
 }
 
 func (p *ParsedFile) String() string {
@@ -49,11 +75,51 @@ type Options struct {
 	OriginalFile string
 	MovieFormat  string
 	SeriesFormat string
+	// SpecialsFormat is used for episodes of season 0, SeriesFormat is used when it is empty.
+	SpecialsFormat string
+	// ExtrasFormat is used for movie extras like trailers.
+	ExtrasFormat string
 	Mode         string
+	// Language is the TMDB language (for example "de-DE") used for titles and episode names.
+	Language string
+	// FallbackLanguage is used when no title is available in Language.
+	FallbackLanguage string
+	// Logger receives the log output of parsing, it defaults to the standard logger. It allows
+	// callers that parse files concurrently to keep the output of every file together.
+	Logger log.FieldLogger `json:"-"`
+	// LocalDB is used for lookups instead of TMDB when set.
+	LocalDB *LocalDB `json:"-"`
+	// Sanitize is the name of the sanitization profile used for target names, see SanitizeProfiles.
+	Sanitize string
+	// Replacements are applied to names before the sanitization profile.
+	Replacements map[string]string
+}
+
+func (p *Options) sanitizeProfile() SanitizeProfile {
+	if profile, ok := SanitizeProfiles[p.Sanitize]; ok {
+		return profile
+	}
+	return SanitizeProfiles[DefaultSanitizeProfile]
+}
+
+func (p *Options) logger() log.FieldLogger {
+	if p.Logger == nil {
+		return log.StandardLogger()
+	}
+	return p.Logger
 }
 
 func (p *Options) String() string {
-	return fmt.Sprintf("Lookup: %v, ForceMovie: %v, ForceSeries: %v, OriginalFile: %s, MovieFormat: %s, SeriesFormat: %s, Mode: %s", p.Lookup, p.ForceMovie, p.ForceSeries, p.OriginalFile, p.MovieFormat, p.SeriesFormat, p.Mode)
+	return fmt.Sprintf("Lookup: %v, ForceMovie: %v, ForceSeries: %v, OriginalFile: %s, MovieFormat: %s, SeriesFormat: %s, Mode: %s, Language: %s, FallbackLanguage: %s, Sanitize: %s", p.Lookup, p.ForceMovie, p.ForceSeries, p.OriginalFile, p.MovieFormat, p.SeriesFormat, p.Mode, p.Language, p.FallbackLanguage, p.Sanitize)
+}
+
+// fallbackLanguage returns the language to retry in when nothing is available in Language. It
+// is empty when the retry would ask TMDB the same thing, TMDB answers in en-US by default.
+func (o Options) fallbackLanguage() string {
+	if o.Language == "" || o.FallbackLanguage == o.Language {
+		return ""
+	}
+	return o.FallbackLanguage
 }
 
 func GetDefaultOptions() Options {
@@ -77,13 +143,14 @@ func getOpts(o []Options) (opts Options) {
 
 func NewParsedFile(filePath string, o ...Options) ParsedFile {
 	opts := getOpts(o)
-	log.WithField("options", opts.String()).Debugln("Parsing filename with options")
+	logger := opts.logger()
+	logger.WithField("options", opts.String()).Debugln("Parsing filename with options")
 	f := ParsedFile{Filepath: filePath, OriginalFile: opts.OriginalFile, Options: opts}
 	f.Extension = filepath.Ext(filePath)
 	filename := strings.TrimSuffix(filePath, f.Extension)
 	filename = filepath.Base(filename)
 	f.Filename = filename
-	log.WithFields(log.Fields{"file": f.Filename}).Debugln("Checking file")
+	logger.WithFields(log.Fields{"file": f.Filename}).Debugln("Checking file")
 
 	if SupportedVideoExtensions[f.Extension] {
 		for _, match := range order {
@@ -92,13 +159,13 @@ func NewParsedFile(filePath string, o ...Options) ParsedFile {
 				switch match {
 				case "yearAsSeason":
 					if len(res) > 1 {
-						log.WithField("year", res[2]).Debugln("Found year as season.")
+						logger.WithField("year", res[2]).Debugln("Found year as season.")
 						f.hasYearAsSeason = true
 						f.Season = res[2]
 					}
 				case "year":
 					if f.Season == res[2] {
-						log.Warnln("We found a year that is the same as the season, to prevent issues with looking up the wrong year we are ignoring the found year.")
+						logger.Warnln("We found a year that is the same as the season, to prevent issues with looking up the wrong year we are ignoring the found year.")
 					} else {
 						f.Year = res[2]
 					}
@@ -106,7 +173,7 @@ func NewParsedFile(filePath string, o ...Options) ParsedFile {
 					if f.Season == "" {
 						f.Season = fmt.Sprintf("%02s", res[2])
 					} else {
-						log.Debugln("We already have found a season earlier so skipping the normal season match.")
+						logger.Debugln("We already have found a season earlier so skipping the normal season match.")
 					}
 				case "episode":
 					f.Episode = fmt.Sprintf("%02s", res[1])
@@ -114,12 +181,19 @@ func NewParsedFile(filePath string, o ...Options) ParsedFile {
 					f.Quality = res[1]
 				case "resolution":
 					f.Resolution = res[2]
+				case "codec":
+					f.Codec = res[0]
+				case "proper":
+					f.Proper = true
+				case "repack":
+					f.Repack = true
 				case "groupAnime":
 					f.AnimeGroup = res[1]
 				case "episodeAnime":
 					if f.Episode == "" {
 						f.Episode = strings.Trim(res[0], " ")
 						f.Season = "00"
+						f.absoluteEpisode = true
 					}
 				}
 			}
@@ -128,20 +202,22 @@ func NewParsedFile(filePath string, o ...Options) ParsedFile {
 		// Extract technical info before cleaning process removes it
 		f.extractTechnicalInfo()
 
+		f.ExtraType = extraType(f.SourcePath())
+
 		cleanName := strings.Replace(f.Filename, ".", " ", -1)
 
 		if !f.IsMovie {
-			log.WithFields(log.Fields{"cleanName": cleanName, "year": f.Year, "episode": f.Episode, "season": f.Season}).Debugln("Pre-parsing done, initial result.")
+			logger.WithFields(log.Fields{"cleanName": cleanName, "year": f.Year, "episode": f.Episode, "season": f.Season}).Debugln("Pre-parsing done, initial result.")
 			if opts.ForceMovie || (f.Episode == "" && f.Season == "" && f.Year != "") {
 				f.IsMovie = true
-				log.Debugln("Identified file as a movie")
+				logger.Debugln("Identified file as a movie")
 			} else if opts.ForceSeries || (f.Episode != "" && f.Season != "") {
 				f.IsSeries = true
-				log.Debugln("Identified file as an episode")
+				logger.Debugln("Identified file as an episode")
 			} else {
 				fileParent := filepath.Base(filepath.Dir(filePath))
 				if fileParent != "" && opts.OriginalFile == "" && fileParent != "." {
-					log.WithFields(log.Fields{"file": f.Filename, "filePath": filePath, "fileParent": fileParent}).Warnln("Nothing sensible found, trying again with parent.")
+					logger.WithFields(log.Fields{"file": f.Filename, "filePath": filePath, "fileParent": fileParent}).Warnln("Nothing sensible found, trying again with parent.")
 					opts.OriginalFile = filePath
 					return NewParsedFile(fileParent+f.Extension, opts)
 				}
@@ -162,7 +238,7 @@ func NewParsedFile(filePath string, o ...Options) ParsedFile {
 							oldName := cleanName
 							cleanName = matchers[match].ReplaceAllString(cleanName, " ")
 							if len(strings.TrimRight(cleanName, " ")) < 2 {
-								log.WithFields(log.Fields{"matcher": match, "newName": cleanName, "oldName": oldName}).Debugln("The match we just did made the name of the content smaller than two characters, we are going to assume something went wrong and reverting to the previous name.")
+								logger.WithFields(log.Fields{"matcher": match, "newName": cleanName, "oldName": oldName}).Debugln("The match we just did made the name of the content smaller than two characters, we are going to assume something went wrong and reverting to the previous name.")
 								cleanName = oldName
 							}
 						}
@@ -174,7 +250,7 @@ func NewParsedFile(filePath string, o ...Options) ParsedFile {
 
 			// Anime content is really weird, if we do this we might kill the name completely
 			if f.AnimeGroup == "" {
-				log.WithField("cleanName", cleanName).Debugln("Probably not Anime so cleaning a bit more.")
+				logger.WithField("cleanName", cleanName).Debugln("Probably not Anime so cleaning a bit more.")
 				cleanName = regexp.MustCompile(`\s{2,}.*`).ReplaceAllString(cleanName, "")
 				//cleanName = strings.Trim(cleanName, " -")
 				cleanName = cases.Title(language.English).String(cleanName)
@@ -188,42 +264,51 @@ func NewParsedFile(filePath string, o ...Options) ParsedFile {
 		return f
 	}
 
-	if opts.Lookup {
-		queryTmdb(&f)
+	if opts.Lookup && opts.LocalDB != nil {
+		queryLocal(&f)
+	} else if opts.Lookup {
+		if err := queryTmdb(&f); IsUnavailable(err) {
+			logger.WithFields(log.Fields{"file": f.Filename, "error": err}).Warnln("Metadata lookup failed, marking file as lookup-failed.")
+			f.LookupFailed = true
+		}
 	}
 
-	if f.ExternalID > 0 && f.hasYearAsSeason {
+	if f.ExternalID > 0 && f.hasYearAsSeason && opts.LocalDB != nil {
+		logger.Warnln("Found an episode that has a year as season but the local title database has no season information so not translating season as year to normal season.")
+	} else if f.ExternalID > 0 && f.hasYearAsSeason {
 		// Translate season as year to season number
 		agent := initAgent()
 		details, err := agent.GetTvInfo(f.ExternalID, nil)
 		if err != nil {
-			log.Errorln("Could not locate TV even though we just found an external ID, this shouldn't be possible. Error:", err)
+			logger.Errorln("Could not locate TV even though we just found an external ID, this shouldn't be possible. Error:", err)
+			f.LookupFailed = f.LookupFailed || IsUnavailable(err)
+			details = &tmdb.TV{}
 		}
 		couldTranslate := false
 		for _, s := range details.Seasons {
 			if s.Name == fmt.Sprintf("Season %s", f.Season) {
-				log.Debugln("Found a match for the season name, using season number.")
+				logger.Debugln("Found a match for the season name, using season number.")
 				f.Season = strconv.Itoa(s.SeasonNumber)
 				couldTranslate = true
 				break
 			}
 		}
 		if !couldTranslate {
-			log.Warnln("Could not translate season as year to normal season :-(")
+			logger.Warnln("Could not translate season as year to normal season :-(")
 		}
 	} else if f.hasYearAsSeason && !f.Options.Lookup {
-		log.Warnln("Found an episode that has a year as season but lookup is disabled so not translating season as year to normal season.")
+		logger.Warnln("Found an episode that has a year as season but lookup is disabled so not translating season as year to normal season.")
 	}
 
 	if addYearToSeries[f.CleanName] && f.Year != "" {
-		log.WithFields(log.Fields{"year": f.Year, "name": f.CleanName}).Debugln("Found seriesname that has multiple series with the same name but different years so adding the year into the final name.")
+		logger.WithFields(log.Fields{"year": f.Year, "name": f.CleanName}).Debugln("Found seriesname that has multiple series with the same name but different years so adding the year into the final name.")
 		f.CleanName = fmt.Sprintf("%s (%s)", f.CleanName, f.Year)
 	}
 
 	// Windows really hates colons, so lets strip them out.
 	f.CleanName = strings.Replace(f.CleanName, ":", "", -1)
 
-	log.WithField("cleanName", f.String()).Debugln("Done parsing filename.")
+	logger.WithField("cleanName", f.String()).Debugln("Done parsing filename.")
 
 	return f
 }
@@ -238,6 +323,7 @@ func (p *ParsedFile) SourcePath() string {
 }
 
 func queryTmdb(p *ParsedFile) error {
+	logger := p.Options.logger()
 	agent := initAgent()
 
 	var options = make(map[string]string)
@@ -247,101 +333,412 @@ func queryTmdb(p *ParsedFile) error {
 		options["year"] = p.Year
 	}
 
-	log.WithFields(log.Fields{"year": p.Year, "title": p.CleanName}).Debugln("Trying to locate data from TMDB")
+	if p.Options.Language != "" {
+		options["language"] = p.Options.Language
+	}
+
+	logger.WithFields(log.Fields{"year": p.Year, "title": p.CleanName, "language": p.Options.Language}).Debugln("Trying to locate data from TMDB")
 	if p.IsSeries {
 		searchRes, err := agent.SearchTv(p.CleanName, options)
 		if err != nil {
-			log.WithFields(log.Fields{"name": p.CleanName, "error": err}).Warnln("Got an error from TMDB")
+			logger.WithFields(log.Fields{"name": p.CleanName, "error": err}).Warnln("Got an error from TMDB")
 			return err
 		}
 
 		if len(searchRes.Results) > 0 {
 			tv := searchRes.Results[0] // Take the first result for now
-			log.Debugln("TV:", tv)
+			logger.Debugln("TV:", tv)
 			p.ExternalID = tv.ID
 			p.ExternalName = tv.Name
+			p.OriginalTitle = tv.OriginalName
 			p.CleanName = tv.Name
+
+			if p.CleanName == "" && p.Options.fallbackLanguage() != "" {
+				details, err := agent.GetTvInfo(tv.ID, map[string]string{"language": p.Options.fallbackLanguage()})
+				if IsUnavailable(err) {
+					p.LookupFailed = true
+					return err
+				} else if err == nil {
+					p.ExternalName = details.Name
+					p.CleanName = details.Name
+				}
+			}
+			if p.CleanName == "" {
+				p.CleanName = tv.OriginalName
+			}
 			if tv.FirstAirDate != "" && p.Year == "" {
-				p.Year = strings.Split(tv.FirstAirDate, "-")[0]
+				p.Year = yearOf(tv.FirstAirDate)
 			}
-			
+
 			// Fetch episode name if we have season and episode information
-			if p.Season != "" && p.Episode != "" {
-				seasonNum, err1 := strconv.Atoi(p.Season)
-				episodeNum, err2 := strconv.Atoi(p.Episode)
-				if err1 == nil && err2 == nil {
-					episodeInfo, err := agent.GetTvEpisodeInfo(tv.ID, seasonNum, episodeNum, nil)
-					if err == nil && episodeInfo.Name != "" {
-						// Clean episode name for filesystem compatibility
-						p.EpisodeName = strings.Replace(episodeInfo.Name, ":", "", -1)
-						p.EpisodeName = strings.Replace(p.EpisodeName, "/", "-", -1)
-						p.EpisodeName = strings.Replace(p.EpisodeName, "\\", "-", -1)
-						log.WithFields(log.Fields{"episodeName": p.EpisodeName, "season": seasonNum, "episode": episodeNum}).Debugln("Found episode name from TMDB")
-					} else {
-						log.WithFields(log.Fields{"season": seasonNum, "episode": episodeNum, "error": err}).Debugln("Could not fetch episode name from TMDB")
-					}
-				}
+			if err := queryEpisodeName(p, agent, logger); err != nil {
+				return err
 			}
 		} else {
-			log.Debugln("No results found on TMDB")
+			logger.Debugln("No results found on TMDB")
 		}
 
 	} else if p.IsMovie {
 		searchRes, err := agent.SearchMovie(p.CleanName, options)
 		if err != nil {
-			log.WithFields(log.Fields{"name": p.CleanName, "error": err}).Warnln("Got an error from TMDB")
+			logger.WithFields(log.Fields{"name": p.CleanName, "error": err}).Warnln("Got an error from TMDB")
 			return err
 		}
 
 		if len(searchRes.Results) > 0 {
 
 			mov := searchRes.Results[0] // Take the first result for now
-			log.Debugln("Movie:", mov)
+			logger.Debugln("Movie:", mov)
 
 			p.ExternalID = mov.ID
 			p.ExternalName = mov.Title
+			p.OriginalTitle = mov.OriginalTitle
 			p.CleanName = mov.Title
 
+			if p.CleanName == "" && p.Options.fallbackLanguage() != "" {
+				details, err := agent.GetMovieInfo(mov.ID, map[string]string{"language": p.Options.fallbackLanguage()})
+				if IsUnavailable(err) {
+					p.LookupFailed = true
+					return err
+				} else if err == nil {
+					p.ExternalName = details.Title
+					p.CleanName = details.Title
+				}
+			}
+			if p.CleanName == "" {
+				p.CleanName = mov.OriginalTitle
+			}
+
 		} else {
-			log.Debugln("No results found on TMDB")
+			logger.Debugln("No results found on TMDB")
+		}
+	}
+
+	logger.WithFields(log.Fields{"externalID": p.ExternalID, "externalName": p.ExternalName, "originalTitle": p.OriginalTitle}).Debugln("Received TMDB results.")
+
+	return queryExtras(p, agent)
+}
+
+// queryEpisodeName fetches the name of the episode from TMDB, the file has to be identified
+// already. Only errors of an unavailable provider are returned, the file is marked then.
+func queryEpisodeName(p *ParsedFile, agent *Client, logger log.FieldLogger) error {
+	seasonNum, err1 := strconv.Atoi(p.Season)
+	episodeNum, err2 := strconv.Atoi(p.Episode)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+
+	name, err := episodeName(logger, agent, p.ExternalID, seasonNum, episodeNum, p.Options.Language)
+	if name == "" && !IsUnavailable(err) && p.Options.fallbackLanguage() != "" {
+		logger.WithFields(log.Fields{"language": p.Options.Language, "fallbackLanguage": p.Options.FallbackLanguage}).Debugln("No episode name in requested language, trying fallback language")
+		name, err = episodeName(logger, agent, p.ExternalID, seasonNum, episodeNum, p.Options.fallbackLanguage())
+	}
+	if IsUnavailable(err) {
+		p.LookupFailed = true
+		return err
+	}
+	if name != "" {
+		// Clean episode name for filesystem compatibility
+		p.EpisodeName = strings.Replace(name, ":", "", -1)
+		p.EpisodeName = strings.Replace(p.EpisodeName, "/", "-", -1)
+		p.EpisodeName = strings.Replace(p.EpisodeName, "\\", "-", -1)
+		logger.WithFields(log.Fields{"episodeName": p.EpisodeName, "season": seasonNum, "episode": episodeNum}).Debugln("Found episode name from TMDB")
+	}
+	return nil
+}
+
+// LookupEpisodeName fetches the episode name again, this is needed when the season or episode
+// changed after the file was parsed.
+func (p *ParsedFile) LookupEpisodeName() error {
+	if !p.Options.Lookup || p.Options.LocalDB != nil || p.LookupFailed || !p.IsSeries || p.ExternalID == 0 {
+		return nil
+	}
+	p.EpisodeName = ""
+	return queryEpisodeName(p, initAgent(), p.Options.logger())
+}
+
+// LookupDetails fetches the TMDB details and external IDs the format needs when they were not
+// fetched yet, this is needed when the format changes after the file was parsed.
+func (p *ParsedFile) LookupDetails() error {
+	if !p.Options.Lookup || p.Options.LocalDB != nil || p.LookupFailed {
+		return nil
+	}
+	return queryExtras(p, initAgent())
+}
+
+// Reidentify replaces the parsed title (and the year when given) and looks the file up again,
+// for files whose name is too far off to be found.
+func (p *ParsedFile) Reidentify(title, year string) error {
+	p.CleanName = strings.TrimSpace(title)
+	if year != "" {
+		p.Year = year
+	}
+	p.ExternalID, p.ExternalName, p.OriginalTitle, p.EpisodeName = 0, "", "", ""
+	p.Genres, p.Collection, p.Certification, p.Country, p.Runtime = nil, "", "", "", 0
+	p.ImdbID, p.TvdbID = "", 0
+	p.detailsFetched, p.externalIDsFetched, p.LookupFailed = false, false, false
+
+	if p.Options.Lookup && p.Options.LocalDB != nil {
+		queryLocal(p)
+	} else if p.Options.Lookup {
+		if err := queryTmdb(p); IsUnavailable(err) {
+			p.LookupFailed = true
+			return err
 		}
 	}
+	p.CleanName = strings.Replace(p.CleanName, ":", "", -1)
+	return p.LookupDetails()
+}
 
-	log.WithFields(log.Fields{"externalID": p.ExternalID, "externalName": p.ExternalName}).Debugln("Received TMDB results.")
+// queryExtras fetches details and external IDs only when the format uses them.
+func queryExtras(p *ParsedFile, agent *Client) error {
+	if p.ExternalID > 0 && !p.detailsFetched && p.formatUses(detailTokens...) {
+		if err := queryDetails(p, agent); err != nil {
+			return err
+		}
+	}
+	if p.ExternalID > 0 && !p.externalIDsFetched && p.formatUses(externalIDTokens...) {
+		if err := queryExternalIDs(p, agent); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// queryLocal looks up the file in the local title database.
+func queryLocal(p *ParsedFile) {
+	logger := p.Options.logger()
+	logger.WithFields(log.Fields{"year": p.Year, "title": p.CleanName}).Debugln("Trying to locate data in the local title database")
+
+	var c Candidate
+	var ok bool
+	if p.IsSeries {
+		c, ok = p.Options.LocalDB.SearchSeries(p.CleanName, p.Year)
+	} else if p.IsMovie {
+		c, ok = p.Options.LocalDB.SearchMovie(p.CleanName, p.Year)
+	}
+	if !ok {
+		logger.Debugln("No results found in the local title database")
+		return
+	}
+
+	p.ExternalID = c.ID
+	p.ExternalName = c.Title
+	p.OriginalTitle = c.OriginalTitle
+	p.CleanName = c.Title
+	if p.Year == "" {
+		p.Year = c.Year
+	}
+
+	logger.WithFields(log.Fields{"externalID": p.ExternalID, "externalName": p.ExternalName}).Debugln("Received local title database results.")
+}
+
+// yearOf returns the year of a TMDB date.
+func yearOf(date string) string {
+	return strings.Split(date, "-")[0]
+}
+
+// episodeName fetches the name of an episode in the given language. TMDB returns a
+// generic "Episode 3" style name when no translation exists, so those are treated as missing.
+func episodeName(logger log.FieldLogger, agent *Client, showID, seasonNum, episodeNum int, language string) (string, error) {
+	var options map[string]string
+	if language != "" {
+		options = map[string]string{"language": language}
+	}
+
+	episodeInfo, err := agent.GetTvEpisodeInfo(showID, seasonNum, episodeNum, options)
+	if err != nil {
+		logger.WithFields(log.Fields{"season": seasonNum, "episode": episodeNum, "language": language, "error": err}).Debugln("Could not fetch episode name from TMDB")
+		return "", err
+	}
+
+	if placeholderEpisodeName.MatchString(episodeInfo.Name) {
+		logger.WithFields(log.Fields{"season": seasonNum, "episode": episodeNum, "language": language, "name": episodeInfo.Name}).Debugln("TMDB returned a placeholder episode name")
+		return "", nil
+	}
+
+	return episodeInfo.Name, nil
+}
+
 // TargetName is the name the file should be renamed to
 func (p *ParsedFile) TargetName() string {
-	var newName string
-
-	if p.IsMovie {
-		newName = p.Options.MovieFormat
-	} else if p.IsSeries {
-		newName = p.Options.SeriesFormat
-		newName = strings.Replace(newName, "{s}", p.Season, -1)
-		newName = strings.Replace(newName, "{e}", p.Episode, -1)
-		newName = strings.Replace(newName, "{t}", p.EpisodeName, -1)
-	} else {
-		newName = p.Filename
+	format := p.format()
+	if format == "" {
+		return strings.TrimRight(strings.Trim(p.Filename, " "), ".") + p.Extension
+	}
+
+	f := cachedFormat(format)
+	profile := p.Options.sanitizeProfile()
+	render := func(limit int) string {
+		return profile.path(f.Render(func(token string) string {
+			v := profile.value(p.tokenValue(token), p.Options.Replacements)
+			if limit > 0 && shrinkableTokens[token] {
+				v = truncate(v, limit)
+			}
+			return v
+		}), p.Extension)
+	}
+
+	target := render(0)
+	over := profile.tooLong(target)
+	if over <= 0 {
+		return target
+	}
+
+	// Shorten the titles until everything fits, the episode markers and extension are kept as is.
+	longest := 0
+	for token := range shrinkableTokens {
+		if n := utf8.RuneCountInString(p.tokenValue(token)); n > longest {
+			longest = n
+		}
 	}
+	for limit := longest - over; limit >= minTitleLength; limit -= 5 {
+		target = render(limit)
+		if profile.tooLong(target) <= 0 {
+			p.Options.logger().WithFields(log.Fields{"target": target, "limit": limit}).Debugln("Shortened titles to fit the maximum name length")
+			return target
+		}
+	}
+
+	return profile.cutComponents(target, p.Extension)
+}
+
+// format returns the format used for the file, it is empty when the file is neither a movie nor a series.
+func (p *ParsedFile) format() string {
+	switch {
+	case p.IsMovie && p.ExtraType != "" && p.Options.ExtrasFormat != "":
+		return p.Options.ExtrasFormat
+	case p.IsMovie:
+		return p.Options.MovieFormat
+	case p.IsSeries && p.IsSpecial() && p.Options.SpecialsFormat != "":
+		return p.Options.SpecialsFormat
+	case p.IsSeries:
+		return p.Options.SeriesFormat
+	}
+	return ""
+}
+
+// formatUses returns whether the format of the file uses any of the given tokens.
+func (p *ParsedFile) formatUses(tokens ...string) bool {
+	format := p.format()
+	if format == "" {
+		return false
+	}
+	for _, used := range cachedFormat(format).Tokens() {
+		for _, t := range tokens {
+			if used == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shrinkableTokens may be shortened when a name gets too long for the filesystem.
+var shrinkableTokens = map[string]bool{"t": true, "n": true, "original_title": true, "i": true}
+
+// minTitleLength is the shortest a title gets before names are simply cut off.
+const minTitleLength = 10
+
+// tokenValue returns the value of a format token.
+func (p *ParsedFile) tokenValue(token string) string {
+	switch token {
+	case "n":
+		return p.CleanName
+	case "y":
+		return p.Year
+	case "s":
+		return p.Season
+	case "e":
+		return p.Episode
+	case "t":
+		return p.EpisodeName
+	case "r":
+		return p.Resolution
+	case "q":
+		return p.Quality
+	case "i":
+		return p.TechnicalInfo
+	case "original_title":
+		return p.originalTitle()
+	case "tmdbid":
+		if p.ExternalID > 0 {
+			return strconv.Itoa(p.ExternalID)
+		}
+	case "imdbid":
+		return p.ImdbID
+	case "tvdbid":
+		if p.TvdbID > 0 {
+			return strconv.Itoa(p.TvdbID)
+		}
+	case "extra":
+		return p.ExtraType
+	case "extra_folder":
+		if folder, ok := extraFolders[p.ExtraType]; ok {
+			return folder
+		}
+		if p.ExtraType != "" {
+			return "extras"
+		}
+	case "fn":
+		return strings.TrimSuffix(filepath.Base(p.SourcePath()), p.Extension)
+	case "genre":
+		if len(p.Genres) > 0 {
+			return p.Genres[0]
+		}
+		if p.IsMovie || p.IsSeries {
+			return unknownGenre
+		}
+	case "collection":
+		return p.Collection
+	case "letter":
+		return sortLetter(p.CleanName)
+	case "country":
+		return p.Country
+	case "cert":
+		return p.Certification
+	}
+	return ""
+}
 
-	newName = strings.Replace(newName, "{n}", p.CleanName, -1)
+// IsSpecial returns whether the file is an episode of season 0.
+func (p *ParsedFile) IsSpecial() bool {
+	if !p.IsSeries || p.absoluteEpisode || p.Season == "" {
+		return false
+	}
+	season, err := strconv.Atoi(p.Season)
+	return err == nil && season == 0
+}
 
-	newName = strings.Replace(newName, "{r}", p.Resolution, -1)
-	newName = strings.Replace(newName, "{q}", p.Quality, -1)
-	newName = strings.Replace(newName, "{y}", p.Year, -1)
-	newName = strings.Replace(newName, "{i}", p.TechnicalInfo, -1)
-	newName = strings.Trim(newName, " ")
+// IsExtra returns whether the given file looks like an extra, for example a trailer.
+func IsExtra(filePath string) bool {
+	return extraType(filePath) != ""
+}
 
-	// Sometimes we end up with an extra dot somehow. This should remove the extra dot
-	// I'm tired, this can probably be done better...
-	if (string(newName[len(newName)-1])) == "." {
-		newName = newName[0 : len(newName)-1]
+// extraType returns the kind of extra the file is, using the names Plex uses.
+func extraType(filePath string) string {
+	name := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	res := extraMatcher.FindStringSubmatch(name)
+	if len(res) == 0 {
+		return ""
 	}
+	kind := strings.ToLower(res[1])
+	switch {
+	case strings.HasPrefix(kind, "behind"):
+		return "behindthescenes"
+	case strings.HasPrefix(kind, "deleted"):
+		return "deleted"
+	}
+	return kind
+}
 
-	return newName + p.Extension
+// originalTitle returns the title in its original language, falling back to the clean name when no lookup was done.
+func (p *ParsedFile) originalTitle() string {
+	if p.OriginalTitle == "" {
+		return p.CleanName
+	}
+	return strings.Replace(p.OriginalTitle, ":", "", -1)
 }
 
 // FullName is the original name of the file without the ful path
@@ -353,7 +750,7 @@ func (p *ParsedFile) FullName() string {
 func (p *ParsedFile) EpisodeNum() (episodeNum int) {
 	episodeNum, err := strconv.Atoi(p.Episode)
 	if err != nil {
-		log.Warnln("Received error when converting episode to int", err)
+		p.Options.logger().Warnln("Received error when converting episode to int", err)
 	}
 
 	return episodeNum
@@ -363,7 +760,7 @@ func (p *ParsedFile) EpisodeNum() (episodeNum int) {
 func (p *ParsedFile) SeasonNum() (seasonNum int) {
 	seasonNum, err := strconv.Atoi(p.Season)
 	if err != nil {
-		log.Warnln("Received error when converting season to int", err)
+		p.Options.logger().Warnln("Received error when converting season to int", err)
 	}
 
 	return seasonNum
@@ -405,7 +802,7 @@ func (p *ParsedFile) extractTechnicalInfo() {
 			technicalInfo := filename[techStart:]
 			// Preserve the technical info exactly as it appears - no modifications
 			p.TechnicalInfo = technicalInfo
-			log.WithFields(log.Fields{"technicalInfo": p.TechnicalInfo}).Debugln("Extracted technical info")
+			p.Options.logger().WithFields(log.Fields{"technicalInfo": p.TechnicalInfo}).Debugln("Extracted technical info")
 		}
 	}
 }
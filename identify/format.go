@@ -0,0 +1,365 @@
+package identify
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Formats are plain text with tokens like {n} that are replaced by the parsed information.
+//
+//   - <...> is an optional section, it is left out completely when any token inside is empty,
+//     for example "{n}< ({y})>" renders as "Angel" when no year is known.
+//   - Tokens accept modifiers separated by colons, for example {e:03} or {n:sort:ascii}, see
+//     formatModifiers.
+//   - {{, }}, << and >> are the literal characters {, }, < and >. Inside an optional section a >
+//     always closes the section, so sections can be nested.
+//
+// After rendering, whitespace is collapsed and separators and brackets that were left behind by
+// empty tokens are removed, so legacy formats without optional sections render cleanly as well.
+
+// formatTokens are all the tokens that can be used in formats.
+var formatTokens = map[string]bool{
+	"n":              true,
+	"y":              true,
+	"s":              true,
+	"e":              true,
+	"t":              true,
+	"r":              true,
+	"q":              true,
+	"i":              true,
+	"original_title": true,
+	"tmdbid":         true,
+	"imdbid":         true,
+	"tvdbid":         true,
+	"extra":          true,
+	"extra_folder":   true,
+	"fn":             true,
+	"genre":          true,
+	"collection":     true,
+	"letter":         true,
+	"country":        true,
+	"cert":           true,
+}
+
+// Format is a parsed movie or series format.
+type Format struct {
+	raw   string
+	nodes []formatNode
+}
+
+type formatNode struct {
+	literal   string
+	token     string
+	modifiers []string
+	optional  []formatNode
+	// isOptional is needed since an optional section might be empty.
+	isOptional bool
+}
+
+// FormatError describes a problem in a format string.
+type FormatError struct {
+	Format   string
+	Position int
+	Message  string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("invalid format '%s' at position %d: %s", e.Format, e.Position+1, e.Message)
+}
+
+// ParseFormat parses a format and returns an error for malformed syntax and unknown tokens.
+func ParseFormat(format string) (*Format, error) {
+	p := formatParser{src: format, strict: true}
+	nodes, err := p.parse(false)
+	if err != nil {
+		return nil, err
+	}
+	return &Format{raw: format, nodes: nodes}, nil
+}
+
+// parseLenient parses a format without ever failing, problems are kept as literal text.
+func parseLenient(format string) *Format {
+	p := formatParser{src: format}
+	nodes, _ := p.parse(false)
+	return &Format{raw: format, nodes: nodes}
+}
+
+var formatCache sync.Map
+
+// cachedFormat returns the lenient parse of the format, formats are parsed only once.
+func cachedFormat(format string) *Format {
+	if f, ok := formatCache.Load(format); ok {
+		return f.(*Format)
+	}
+	f := parseLenient(format)
+	formatCache.Store(format, f)
+	return f
+}
+
+type formatParser struct {
+	src    string
+	pos    int
+	strict bool
+}
+
+func (p *formatParser) errorf(pos int, msg string, args ...interface{}) error {
+	return &FormatError{Format: p.src, Position: pos, Message: fmt.Sprintf(msg, args...)}
+}
+
+// parse parses until the end of the format or, when inOptional is set, the end of the section.
+func (p *formatParser) parse(inOptional bool) ([]formatNode, error) {
+	var nodes []formatNode
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			nodes = append(nodes, formatNode{literal: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case (c == '{' || c == '}' || c == '<' || (c == '>' && !inOptional)) && p.pos+1 < len(p.src) && p.src[p.pos+1] == c:
+			lit.WriteByte(c)
+			p.pos += 2
+		case c == '{':
+			start := p.pos
+			end := strings.IndexByte(p.src[p.pos:], '}')
+			if end == -1 {
+				if p.strict {
+					return nil, p.errorf(start, "unclosed '{'")
+				}
+				lit.WriteString(p.src[p.pos:])
+				p.pos = len(p.src)
+				continue
+			}
+			body := p.src[p.pos+1 : p.pos+end]
+			p.pos += end + 1
+			parts := strings.Split(body, ":")
+			name, modifiers := parts[0], parts[1:]
+			if !formatTokens[name] {
+				if p.strict {
+					if suggestion := closestToken(name); suggestion != "" {
+						return nil, p.errorf(start, "unknown token '{%s}', did you mean '{%s}'?", name, suggestion)
+					}
+					return nil, p.errorf(start, "unknown token '{%s}'", name)
+				}
+				lit.WriteString("{" + body + "}")
+				continue
+			}
+			if mod, ok := invalidModifier(modifiers); !ok {
+				if p.strict {
+					return nil, p.errorf(start, "unknown modifier '%s' in '{%s}'", mod, body)
+				}
+				lit.WriteString("{" + body + "}")
+				continue
+			}
+			flush()
+			nodes = append(nodes, formatNode{token: name, modifiers: modifiers})
+		case c == '}':
+			if p.strict {
+				return nil, p.errorf(p.pos, "unexpected '}', use '}}' for a literal '}'")
+			}
+			lit.WriteByte(c)
+			p.pos++
+		case c == '<':
+			start := p.pos
+			p.pos++
+			children, err := p.parse(true)
+			if err != nil {
+				return nil, err
+			}
+			if p.pos > len(p.src) || p.src[p.pos-1] != '>' {
+				if p.strict {
+					return nil, p.errorf(start, "unclosed '<'")
+				}
+				// Not an optional section after all, keep the text as is.
+				lit.WriteByte('<')
+				flush()
+				nodes = append(nodes, children...)
+				continue
+			}
+			flush()
+			nodes = append(nodes, formatNode{isOptional: true, optional: children})
+		case c == '>':
+			if inOptional {
+				flush()
+				p.pos++
+				return nodes, nil
+			}
+			if p.strict {
+				return nil, p.errorf(p.pos, "unexpected '>', use '>>' for a literal '>'")
+			}
+			lit.WriteByte(c)
+			p.pos++
+		default:
+			lit.WriteByte(c)
+			p.pos++
+		}
+	}
+	flush()
+
+	if inOptional {
+		// Signal the caller that the section was not closed.
+		p.pos = len(p.src) + 1
+	}
+	return nodes, nil
+}
+
+// closestToken returns the known token that is at most two edits away from name, if any.
+func closestToken(name string) string {
+	best, bestDistance := "", 3
+	for token := range formatTokens {
+		d := editDistance(name, token)
+		if d < bestDistance || (d == bestDistance && token < best) {
+			best, bestDistance = token, d
+		}
+	}
+	// Every single letter token is one edit away from another single letter.
+	if len(name) == 1 && bestDistance > 0 {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// Tokens returns the names of all tokens used in the format.
+func (f *Format) Tokens() []string {
+	var tokens []string
+	var walk func(nodes []formatNode)
+	walk = func(nodes []formatNode) {
+		for _, n := range nodes {
+			if n.token != "" {
+				tokens = append(tokens, n.token)
+			}
+			walk(n.optional)
+		}
+	}
+	walk(f.nodes)
+	return tokens
+}
+
+// formatPiece is a rendered part of a format.
+type formatPiece struct {
+	text    string
+	isToken bool
+}
+
+func renderNodes(nodes []formatNode, value func(token string) string) (pieces []formatPiece, complete bool) {
+	complete = true
+	for _, n := range nodes {
+		switch {
+		case n.isOptional:
+			sub, ok := renderNodes(n.optional, value)
+			if ok {
+				pieces = append(pieces, sub...)
+			} else {
+				// A left out section behaves like an empty token.
+				pieces = append(pieces, formatPiece{isToken: true})
+			}
+		case n.token != "":
+			v := applyModifiers(value(n.token), n.modifiers)
+			if v == "" {
+				complete = false
+			}
+			pieces = append(pieces, formatPiece{text: v, isToken: true})
+		default:
+			pieces = append(pieces, formatPiece{text: n.literal})
+		}
+	}
+	return pieces, complete
+}
+
+const formatSeparators = " -._"
+
+var (
+	emptyBrackets   = regexp.MustCompile(`\(\s*\)|\[\s*\]`)
+	repeatedSpaces  = regexp.MustCompile(`\s{2,}`)
+	danglingDashes  = regexp.MustCompile(`\s-(\s+-)+\s`)
+	separatorPrefix = regexp.MustCompile(`[` + regexp.QuoteMeta(formatSeparators) + `]$`)
+)
+
+// emptyIDTags are media server ID tags like {tmdb-} or [imdbid=] left behind by an unknown ID.
+var emptyIDTags = regexp.MustCompile(`\{(?:tmdb|imdb|tvdb)(?:id)?[-=]\s*\}|\[(?:tmdb|imdb|tvdb)(?:id)?[-=]\s*\]`)
+
+// Render renders the format using the value of every token, the result is a relative path using
+// forward slashes.
+func (f *Format) Render(value func(token string) string) string {
+	pieces, _ := renderNodes(f.nodes, value)
+
+	var b strings.Builder
+	dropSeparators := false
+	for _, pc := range pieces {
+		if pc.isToken {
+			if pc.text == "" {
+				// Make sure the separators around the empty token don't end up doubled.
+				dropSeparators = dropSeparators || separatorPrefix.MatchString(b.String())
+				continue
+			}
+			b.WriteString(pc.text)
+			dropSeparators = false
+			continue
+		}
+
+		text := pc.text
+		if dropSeparators {
+			text = strings.TrimLeft(text, formatSeparators)
+			if text == "" {
+				continue
+			}
+		}
+		b.WriteString(text)
+		dropSeparators = false
+	}
+
+	components := strings.Split(b.String(), "/")
+	for i, c := range components {
+		c = emptyIDTags.ReplaceAllString(c, "")
+		c = emptyBrackets.ReplaceAllString(c, "")
+		c = danglingDashes.ReplaceAllString(c, " - ")
+		c = repeatedSpaces.ReplaceAllString(c, " ")
+		c = strings.TrimLeft(c, " -_")
+		if i == len(components)-1 {
+			// The extension is added after this, so a trailing dot would end up doubled.
+			c = strings.TrimRight(c, formatSeparators)
+		} else {
+			c = strings.TrimRight(c, " -_")
+		}
+		components[i] = c
+	}
+
+	return strings.Join(components, "/")
+}
+
+func (f *Format) String() string {
+	return f.raw
+}
@@ -0,0 +1,328 @@
+package identify
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content types used in local title databases.
+const (
+	MovieType  = "movie"
+	SeriesType = "tv"
+)
+
+// LocalDB is an offline title database, it is read-only once loaded and safe for concurrent use.
+type LocalDB struct {
+	Movies []Candidate `json:"movies"`
+	Series []Candidate `json:"series"`
+
+	movieIndex  map[string][]int
+	seriesIndex map[string][]int
+}
+
+// OpenLocalDB loads a database previously written by Save.
+func OpenLocalDB(path string) (*LocalDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := &LocalDB{}
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(db); err != nil {
+		return nil, fmt.Errorf("could not read title database '%s': %s", path, err)
+	}
+	db.buildIndex()
+	return db, nil
+}
+
+// Save writes the database to path, the file is replaced atomically.
+func (db *LocalDB) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".titles-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := json.NewEncoder(w).Encode(db); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Import reads titles from r and merges them into the database, entries with an existing ID are
+// replaced. Supported formats are the TMDB daily ID exports (JSON lines, optionally gzipped),
+// a JSON array of titles and CSV with a header containing at least id and title. contentType is
+// either MovieType or SeriesType, when empty it is taken from the entries themselves.
+// It returns the amount of imported titles.
+func (db *LocalDB) Import(r io.Reader, contentType string) (int, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	first, err := firstNonSpace(br)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []localEntry
+	switch first {
+	case '[':
+		err = json.NewDecoder(br).Decode(&entries)
+	case '{':
+		entries, err = readJSONLines(br)
+	default:
+		entries, err = readCSV(br)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	movies := make(map[int]Candidate)
+	series := make(map[int]Candidate)
+	for _, e := range entries {
+		t := e.contentType(contentType)
+		if t == "" {
+			return 0, fmt.Errorf("could not determine whether '%s' is a movie or series, please supply a type", e.title())
+		}
+		if t == MovieType {
+			movies[e.ID] = e.candidate()
+		} else {
+			series[e.ID] = e.candidate()
+		}
+	}
+
+	db.Movies = mergeCandidates(db.Movies, movies)
+	db.Series = mergeCandidates(db.Series, series)
+	db.buildIndex()
+
+	return len(movies) + len(series), nil
+}
+
+// SearchMovie returns the best matching movie for the given name and year.
+func (db *LocalDB) SearchMovie(name, year string) (Candidate, bool) {
+	return bestCandidate(name, year, db.search(db.Movies, db.movieIndex, name), localMinScore)
+}
+
+// SearchSeries returns the best matching series for the given name and year.
+func (db *LocalDB) SearchSeries(name, year string) (Candidate, bool) {
+	return bestCandidate(name, year, db.search(db.Series, db.seriesIndex, name), localMinScore)
+}
+
+// search returns all candidates sharing one of the two rarest words of the name. Words no title
+// has, like "Directors Cut", are left out so they don't take the place of a real one.
+func (db *LocalDB) search(all []Candidate, index map[string][]int, name string) []Candidate {
+	var words []string
+	for _, w := range strings.Fields(normalizeTitle(name)) {
+		if len(index[w]) > 0 {
+			words = append(words, w)
+		}
+	}
+	sort.Slice(words, func(i, j int) bool { return len(index[words[i]]) < len(index[words[j]]) })
+
+	seen := make(map[int]bool)
+	var candidates []Candidate
+	for i, w := range words {
+		if i == 2 {
+			break
+		}
+		for _, idx := range index[w] {
+			if !seen[idx] {
+				seen[idx] = true
+				candidates = append(candidates, all[idx])
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Popularity > candidates[j].Popularity })
+
+	return candidates
+}
+
+func (db *LocalDB) buildIndex() {
+	db.movieIndex = indexCandidates(db.Movies)
+	db.seriesIndex = indexCandidates(db.Series)
+}
+
+func indexCandidates(candidates []Candidate) map[string][]int {
+	index := make(map[string][]int)
+	for i, c := range candidates {
+		seen := make(map[string]bool)
+		for _, w := range strings.Fields(normalizeTitle(c.Title + " " + c.OriginalTitle)) {
+			if !seen[w] {
+				seen[w] = true
+				index[w] = append(index[w], i)
+			}
+		}
+	}
+	return index
+}
+
+func mergeCandidates(existing []Candidate, imported map[int]Candidate) []Candidate {
+	if len(imported) == 0 {
+		return existing
+	}
+	merged := make([]Candidate, 0, len(existing)+len(imported))
+	for _, c := range existing {
+		if _, ok := imported[c.ID]; !ok {
+			merged = append(merged, c)
+		}
+	}
+	for _, c := range imported {
+		merged = append(merged, c)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].ID < merged[j].ID })
+	return merged
+}
+
+// localEntry is a single title as found in the supported import formats.
+type localEntry struct {
+	ID            int     `json:"id"`
+	Title         string  `json:"title"`
+	Name          string  `json:"name"`
+	OriginalTitle string  `json:"original_title"`
+	OriginalName  string  `json:"original_name"`
+	Year          string  `json:"year"`
+	Type          string  `json:"type"`
+	Popularity    float64 `json:"popularity"`
+}
+
+func (e localEntry) title() string {
+	for _, t := range []string{e.Title, e.Name, e.OriginalTitle, e.OriginalName} {
+		if t != "" {
+			return t
+		}
+	}
+	return ""
+}
+
+func (e localEntry) contentType(fallback string) string {
+	switch strings.ToLower(e.Type) {
+	case "movie", "movies":
+		return MovieType
+	case "tv", "series", "show":
+		return SeriesType
+	}
+	if fallback != "" {
+		return fallback
+	}
+	// TMDB exports only contain original_title for movies and original_name for series.
+	if e.Title != "" || e.Name != "" {
+		return ""
+	}
+	if e.OriginalTitle != "" && e.OriginalName == "" {
+		return MovieType
+	}
+	if e.OriginalName != "" && e.OriginalTitle == "" {
+		return SeriesType
+	}
+	return ""
+}
+
+func (e localEntry) candidate() Candidate {
+	original := e.OriginalTitle
+	if original == "" {
+		original = e.OriginalName
+	}
+	return Candidate{ID: e.ID, Title: e.title(), OriginalTitle: original, Year: e.Year, Popularity: e.Popularity}
+}
+
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\n' && b != '\r' && b != '\t' {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+func readJSONLines(r io.Reader) ([]localEntry, error) {
+	var entries []localEntry
+	dec := json.NewDecoder(r)
+	for {
+		var e localEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func readCSV(r io.Reader) ([]localEntry, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := columns["id"]; !ok {
+		return nil, fmt.Errorf("CSV header needs an id column")
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, fmt.Errorf("CSV header needs a title column")
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []localEntry
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.Atoi(field(record, "id"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid id '%s' in CSV", field(record, "id"))
+		}
+		popularity, _ := strconv.ParseFloat(field(record, "popularity"), 64)
+		entries = append(entries, localEntry{
+			ID:            id,
+			Title:         field(record, "title"),
+			OriginalTitle: field(record, "original_title"),
+			Year:          field(record, "year"),
+			Type:          field(record, "type"),
+			Popularity:    popularity,
+		})
+	}
+}
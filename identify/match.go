@@ -0,0 +1,123 @@
+package identify
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Candidate is a possible match for a parsed file, coming from either TMDB or a local dataset.
+type Candidate struct {
+	ID            int     `json:"id"`
+	Title         string  `json:"title"`
+	OriginalTitle string  `json:"original_title,omitempty"`
+	Year          string  `json:"year,omitempty"`
+	Popularity    float64 `json:"popularity,omitempty"`
+}
+
+// localMinScore is the score a local candidate needs to be accepted.
+const localMinScore = 0.6
+
+// scoreCandidate scores how well a candidate matches the given name and year, 1 is a perfect
+// title match and the year and popularity nudge the score up or down.
+func scoreCandidate(name, year string, c Candidate) float64 {
+	score := titleScore(name, c.Title)
+	if c.OriginalTitle != "" {
+		score = math.Max(score, titleScore(name, c.OriginalTitle))
+	}
+
+	if year != "" && c.Year != "" {
+		want, err1 := strconv.Atoi(year)
+		got, err2 := strconv.Atoi(c.Year)
+		if err1 == nil && err2 == nil {
+			switch diff := want - got; {
+			case diff == 0:
+				score += 0.2
+			case diff == 1 || diff == -1:
+				score += 0.1
+			default:
+				score -= 0.3
+			}
+		}
+	}
+
+	// Popularity is only a tie breaker.
+	score += math.Min(math.Log10(1+c.Popularity)/100, 0.05)
+
+	return score
+}
+
+// bestCandidate returns the best scoring candidate that scores at least minScore.
+func bestCandidate(name, year string, candidates []Candidate, minScore float64) (Candidate, bool) {
+	if len(candidates) == 0 {
+		return Candidate{}, false
+	}
+
+	best, bestScore := 0, math.Inf(-1)
+	for i, c := range candidates {
+		// Strictly greater so candidates that score the same keep the order of the provider.
+		if score := scoreCandidate(name, year, c); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	if bestScore < minScore {
+		return Candidate{}, false
+	}
+	return candidates[best], true
+}
+
+// titleScore compares two titles, identical titles score 1 otherwise the dice coefficient of the words is used.
+func titleScore(a, b string) float64 {
+	na, nb := normalizeTitle(a), normalizeTitle(b)
+	if na == "" || nb == "" {
+		return 0
+	}
+	if na == nb {
+		return 1
+	}
+
+	wa, wb := strings.Fields(na), strings.Fields(nb)
+	words := make(map[string]int, len(wa))
+	for _, w := range wa {
+		words[w]++
+	}
+	shared := 0
+	for _, w := range wb {
+		if words[w] > 0 {
+			words[w]--
+			shared++
+		}
+	}
+
+	return 2 * float64(shared) / float64(len(wa)+len(wb))
+}
+
+// normalizeTitle lowercases a title and removes accents and punctuation.
+func normalizeTitle(title string) string {
+	// Transformers keep state so a new chain is needed for every call.
+	stripMarks := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	t, _, err := transform.String(stripMarks, title)
+	if err != nil {
+		t = title
+	}
+	t = strings.ToLower(t)
+	t = strings.Map(func(r rune) rune {
+		if r == '&' {
+			return ' '
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return r
+		}
+		if r == '\'' {
+			return -1
+		}
+		return ' '
+	}, t)
+	return strings.Join(strings.Fields(t), " ")
+}
@@ -0,0 +1,117 @@
+package identify
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// formatModifiers are the modifiers tokens accept. Besides these a number truncates the value to
+// that many characters ({t:40}) and a number with a leading zero pads a numeric value with zeros
+// to that width ({e:03}).
+var formatModifiers = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"title": func(v string) string { return cases.Title(language.English).String(v) },
+	"sort":  sortName,
+	"ascii": asciiName,
+}
+
+// sortArticles are moved to the end of a name by the sort modifier.
+var sortArticles = []string{"The", "A", "An"}
+
+var numericModifier = regexp.MustCompile(`^0?[0-9]+$`)
+
+// invalidModifier returns the first unknown modifier.
+func invalidModifier(modifiers []string) (string, bool) {
+	for _, m := range modifiers {
+		if _, ok := formatModifiers[m]; !ok && !numericModifier.MatchString(m) {
+			return m, false
+		}
+	}
+	return "", true
+}
+
+func applyModifiers(v string, modifiers []string) string {
+	for _, m := range modifiers {
+		if v == "" {
+			return v
+		}
+		if fn, ok := formatModifiers[m]; ok {
+			v = fn(v)
+			continue
+		}
+
+		width, err := strconv.Atoi(m)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(m, "0") {
+			v = padNumber(v, width)
+		} else {
+			v = truncate(v, width)
+		}
+	}
+	return v
+}
+
+// padNumber zero pads a numeric value, other values like anime episode numbers are left alone.
+func padNumber(v string, width int) string {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return v
+	}
+	return fmt.Sprintf("%0*d", width, n)
+}
+
+// truncate cuts a value to at most max characters, preferably at the end of a word.
+func truncate(v string, max int) string {
+	r := []rune(v)
+	if len(r) <= max {
+		return v
+	}
+	cut := string(r[:max])
+	if i := strings.LastIndexByte(cut, ' '); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, formatSeparators+",;")
+}
+
+// sortName moves a leading article to the end, "The Matrix" becomes "Matrix, The".
+func sortName(v string) string {
+	for _, article := range sortArticles {
+		if len(v) > len(article)+1 && strings.EqualFold(v[:len(article)+1], article+" ") {
+			return v[len(article)+1:] + ", " + v[:len(article)]
+		}
+	}
+	return v
+}
+
+// asciiReplacements are letters that don't decompose into an ASCII letter and a mark.
+var asciiReplacements = strings.NewReplacer(
+	"ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ø", "o", "Ø", "O",
+	"ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "þ", "th", "Þ", "TH", "ð", "d", "Ð", "D",
+)
+
+// asciiName transliterates accented letters and drops everything that is not ASCII.
+func asciiName(v string) string {
+	v = asciiReplacements.Replace(v)
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if res, _, err := transform.String(t, v); err == nil {
+		v = res
+	}
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return -1
+		}
+		return r
+	}, v)
+}
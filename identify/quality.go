@@ -0,0 +1,123 @@
+package identify
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// QualityRanking orders releases, every list goes from best to worst. Values that are not in a
+// list rank below all listed values.
+type QualityRanking struct {
+	Resolutions []string `json:"resolutions,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+	Codecs      []string `json:"codecs,omitempty"`
+}
+
+// DefaultQualityRanking prefers resolution over source over codec.
+var DefaultQualityRanking = QualityRanking{
+	Resolutions: []string{"2160p", "1440p", "1080p", "720p", "576p", "480p", "360p"},
+	Sources:     []string{"bluray", "webdl", "webrip", "hdrip", "bdrip", "brrip", "hdtv", "dvdrip", "pdtv", "dvdscr", "ts", "telesync", "hdcam", "camrip", "cam"},
+	Codecs:      []string{"h265", "h264", "xvid"},
+}
+
+// Compare returns a positive number when a is a better release than b, a negative number when
+// it is worse and 0 when they are equally good. Resolution is compared first, then source,
+// codec and finally PROPER and REPACK releases win over the original.
+func (r QualityRanking) Compare(a, b ParsedFile) int {
+	if r.Resolutions == nil {
+		r.Resolutions = DefaultQualityRanking.Resolutions
+	}
+	if r.Sources == nil {
+		r.Sources = DefaultQualityRanking.Sources
+	}
+	if r.Codecs == nil {
+		r.Codecs = DefaultQualityRanking.Codecs
+	}
+
+	if c := compareRank(r.Resolutions, normalizeQuality(a.Resolution), normalizeQuality(b.Resolution)); c != 0 {
+		return c
+	}
+	if c := compareRank(r.Sources, normalizeQuality(a.Quality), normalizeQuality(b.Quality)); c != 0 {
+		return c
+	}
+	if c := compareRank(r.Codecs, normalizeCodec(a.Codec), normalizeCodec(b.Codec)); c != 0 {
+		return c
+	}
+	return boolRank(a.Proper || a.Repack) - boolRank(b.Proper || b.Repack)
+}
+
+// compareRank compares the position of a and b in ranking, earlier is better.
+func compareRank(ranking []string, a, b string) int {
+	return rankOf(ranking, b) - rankOf(ranking, a)
+}
+
+func rankOf(ranking []string, v string) int {
+	for i, r := range ranking {
+		if normalizeQuality(r) == v && v != "" {
+			return i
+		}
+	}
+	return len(ranking)
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// normalizeQuality lowercases a value and drops everything but letters and digits, so WEB-DL
+// and webdl are the same.
+func normalizeQuality(v string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, v)
+}
+
+func normalizeCodec(v string) string {
+	v = normalizeQuality(v)
+	switch v {
+	case "x265", "hevc":
+		return "h265"
+	case "x264", "avc":
+		return "h264"
+	}
+	return v
+}
+
+// SameIdentity returns whether a and b are the same movie or the same episode, ignoring the
+// release. Years that are part of a series name are ignored so "The Flash (2014)" matches
+// "The Flash".
+func SameIdentity(a, b ParsedFile) bool {
+	if a.IsMovie != b.IsMovie || a.IsSeries != b.IsSeries || !(a.IsMovie || a.IsSeries) {
+		return false
+	}
+	if a.ExtraType != "" || b.ExtraType != "" {
+		return false
+	}
+	if titleScore(stripYear(a.CleanName), stripYear(b.CleanName)) < 0.8 {
+		return false
+	}
+	if a.IsMovie {
+		return a.Year == "" || b.Year == "" || a.Year == b.Year
+	}
+	return sameNumber(a.Season, b.Season) && sameNumber(a.Episode, b.Episode)
+}
+
+func stripYear(name string) string {
+	return strings.TrimSpace(matchers["year"].ReplaceAllString(name, ""))
+}
+
+func sameNumber(a, b string) bool {
+	na, err1 := strconv.Atoi(a)
+	nb, err2 := strconv.Atoi(b)
+	if err1 != nil || err2 != nil {
+		return a == b
+	}
+	return na == nb
+}
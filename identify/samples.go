@@ -0,0 +1,18 @@
+package identify
+
+// SampleNames are file names covering the naming schemes the parser understands, they are used
+// by `format preview` and the tests.
+var SampleNames = []string{
+	"The Matrix Revolutions (2003).mkv",
+	"K-PAX (2001).mkv",
+	"Sonic.the.Hedgehog.2020.1080p.HDRip.X264.AC3-EVO.mkv",
+	"Weekend.At.Bernie's.1989.1080p.BluRay.FLAC2.0.x264-DON.mkv",
+	"Apollo.11.2019.1080p.mkv",
+	"The.Matrix.1999.Trailer.mkv",
+	"Angel.S04E12.mkv",
+	"Doctor.Who.S00E01.mkv",
+	"Mythbusters.S2005E03.Brown.Note.mkv",
+	"Downton Abbey 5x06 HDTV x264-FoV [eztv].mkv",
+	"The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv",
+	"[HorribleSubs] Fruits Basket (2019) - 01 [1080p].mkv",
+}
@@ -0,0 +1,197 @@
+package identify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SanitizeProfile describes what names a filesystem accepts.
+type SanitizeProfile struct {
+	// InvalidChars can't be used in a path component, they are replaced using Replacements or
+	// removed when there is no replacement.
+	InvalidChars string
+	Replacements map[string]string
+	// ReservedNames can't be used as a name, not even with an extension.
+	ReservedNames bool
+	// TrimTrailing are characters a path component can't end with.
+	TrimTrailing string
+	// MaxComponentBytes is the maximum length of a single path component.
+	MaxComponentBytes int
+	// CaseInsensitive is set when names that only differ in case are the same file.
+	CaseInsensitive bool
+}
+
+// DefaultSanitizeProfile is used when no profile is configured.
+const DefaultSanitizeProfile = "posix"
+
+var windowsReplacements = map[string]string{
+	"/":  "-",
+	"\\": "-",
+	":":  "",
+	"\"": "'",
+	"|":  "-",
+	"?":  "",
+	"*":  "",
+	"<":  "",
+	">":  "",
+}
+
+// windowsProfile is shared by every filesystem following the Windows rules.
+var windowsProfile = SanitizeProfile{
+	InvalidChars:      "/\\:\"|?*<>",
+	Replacements:      windowsReplacements,
+	ReservedNames:     true,
+	TrimTrailing:      " .",
+	MaxComponentBytes: 255,
+	CaseInsensitive:   true,
+}
+
+// SanitizeProfiles are the known sanitization profiles. smb follows the Windows rules since
+// Windows clients have to be able to open everything on the share, FAT32 has the same rules
+// for long names.
+var SanitizeProfiles = map[string]SanitizeProfile{
+	"posix": {
+		InvalidChars:      "/\x00",
+		Replacements:      map[string]string{"/": "-"},
+		MaxComponentBytes: 255,
+	},
+	"windows": windowsProfile,
+	"smb":     windowsProfile,
+	"fat32":   windowsProfile,
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeProfileNames returns the names of all profiles.
+func SanitizeProfileNames() []string {
+	names := make([]string, 0, len(SanitizeProfiles))
+	for name := range SanitizeProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseReplacements parses a comma separated list of from=to pairs, for example ":= -,&=and".
+func ParseReplacements(s string) (map[string]string, error) {
+	replacements := make(map[string]string)
+	if s == "" {
+		return replacements, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid replacement '%s', expected from=to", pair)
+		}
+		replacements[parts[0]] = parts[1]
+	}
+	return replacements, nil
+}
+
+// value sanitizes a token value, the extra replacements take precedence over the profile ones.
+func (s SanitizeProfile) value(v string, extra map[string]string) string {
+	v = replaceAll(v, extra)
+	var b strings.Builder
+	for _, r := range v {
+		switch {
+		case r < 0x20:
+			continue
+		case strings.ContainsRune(s.InvalidChars, r):
+			b.WriteString(s.Replacements[string(r)])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// component sanitizes a single rendered path component.
+func (s SanitizeProfile) component(c string) string {
+	// Slashes can't be in here anymore, they separate the components.
+	c = s.value(c, nil)
+	if s.TrimTrailing != "" {
+		c = strings.TrimRight(c, s.TrimTrailing)
+	}
+	if s.ReservedNames {
+		base := c
+		if i := strings.IndexByte(c, '.'); i >= 0 {
+			base = c[:i]
+		}
+		if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+			c = base + "_" + c[len(base):]
+		}
+	}
+	return c
+}
+
+// path sanitizes every component of a rendered path, the extension is added to the last one.
+func (s SanitizeProfile) path(name, ext string) string {
+	components := strings.Split(name, "/")
+	for i, c := range components {
+		if i == len(components)-1 {
+			c = s.component(c + ext)
+		} else {
+			c = s.component(c)
+		}
+		components[i] = c
+	}
+	return strings.Join(components, "/")
+}
+
+// tooLong returns how many bytes the longest component of the path is over the limit.
+func (s SanitizeProfile) tooLong(path string) int {
+	over := 0
+	for _, c := range strings.Split(path, "/") {
+		if n := len(c) - s.MaxComponentBytes; n > over {
+			over = n
+		}
+	}
+	return over
+}
+
+// cutComponents is the last resort to make a path fit, it cuts every component that is too
+// long while keeping the extension of the last one.
+func (s SanitizeProfile) cutComponents(path, ext string) string {
+	components := strings.Split(path, "/")
+	for i, c := range components {
+		keep := ""
+		if i == len(components)-1 && strings.HasSuffix(c, ext) {
+			c, keep = strings.TrimSuffix(c, ext), ext
+		}
+		max := s.MaxComponentBytes - len(keep)
+		for len(c) > max {
+			_, size := utf8.DecodeLastRuneInString(c)
+			c = c[:len(c)-size]
+		}
+		components[i] = strings.TrimRight(c, formatSeparators) + keep
+	}
+	return strings.Join(components, "/")
+}
+
+func replaceAll(v string, replacements map[string]string) string {
+	if len(replacements) == 0 {
+		return v
+	}
+	// Longest first so overlapping replacements behave predictably.
+	from := make([]string, 0, len(replacements))
+	for f := range replacements {
+		from = append(from, f)
+	}
+	sort.Slice(from, func(i, j int) bool {
+		if len(from[i]) != len(from[j]) {
+			return len(from[i]) > len(from[j])
+		}
+		return from[i] < from[j]
+	})
+	pairs := make([]string, 0, 2*len(from))
+	for _, f := range from {
+		pairs = append(pairs, f, replacements[f])
+	}
+	return strings.NewReplacer(pairs...).Replace(v)
+}
@@ -2,14 +2,73 @@ package identify
 
 import (
 	"regexp"
-
-	"github.com/ryanbradynd05/go-tmdb"
+	"sort"
 )
 
 const tmdbAPIKey = "0cdacd9ab172ac6ff69c8d84b2c938a8"
 const DefaultMovieFormat = "{n} ({y})/{n} ({y}) {r}"
 const DefaultSeriesFormat = "{n}/Season {s}/{n} - S{s}E{e} - {t} {i}"
 
+// Preset is a set of formats following the naming conventions of a media server.
+type Preset struct {
+	MovieFormat  string
+	SeriesFormat string
+	// SpecialsFormat is used for episodes of season 0.
+	SpecialsFormat string
+	// ExtrasFormat is used for movie extras like trailers and featurettes.
+	ExtrasFormat string
+}
+
+// Presets are the naming conventions of the supported media servers. Series folders don't get
+// the year since names like "The Flash (2014)" already contain it when needed.
+var Presets = map[string]Preset{
+	"plex": {
+		MovieFormat:    "{n}< ({y})>< {{tmdb-{tmdbid}}}>/{n}< ({y})>",
+		SeriesFormat:   "{n}< {{tmdb-{tmdbid}}}>/Season {s}/{n} - s{s}e{e}< - {t}>",
+		SpecialsFormat: "{n}< {{tmdb-{tmdbid}}}>/Specials/{n} - s{s}e{e}< - {t}>",
+		ExtrasFormat:   "{n}< ({y})>< {{tmdb-{tmdbid}}}>/{fn}-{extra}",
+	},
+	"jellyfin": {
+		MovieFormat:    "{n}< ({y})>< [tmdbid-{tmdbid}]>/{n}< ({y})>",
+		SeriesFormat:   "{n}< [tmdbid-{tmdbid}]>/Season {s}/{n} S{s}E{e}< - {t}>",
+		SpecialsFormat: "{n}< [tmdbid-{tmdbid}]>/Specials/{n} S{s}E{e}< - {t}>",
+		ExtrasFormat:   "{n}< ({y})>< [tmdbid-{tmdbid}]>/{extra_folder}/{fn}",
+	},
+	"emby": {
+		MovieFormat:    "{n}< ({y})>< [tmdbid={tmdbid}]>/{n}< ({y})>",
+		SeriesFormat:   "{n}< [tmdbid={tmdbid}]>/Season {s}/{n} - S{s}E{e}< - {t}>",
+		SpecialsFormat: "{n}< [tmdbid={tmdbid}]>/Specials/{n} - S{s}E{e}< - {t}>",
+		ExtrasFormat:   "{n}< ({y})>< [tmdbid={tmdbid}]>/{extra_folder}/{fn}",
+	},
+	"kodi": {
+		MovieFormat:    "{n}< ({y})>/{n}< ({y})>",
+		SeriesFormat:   "{n}/Season {s}/{n} S{s}E{e}< - {t}>",
+		SpecialsFormat: "{n}/Specials/{n} S{s}E{e}< - {t}>",
+		ExtrasFormat:   "{n}< ({y})>/Extras/{fn}",
+	},
+}
+
+// PresetNames returns the names of all presets.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// extraFolders are the folder names media servers use for the different kinds of extras.
+var extraFolders = map[string]string{
+	"trailer":         "trailers",
+	"featurette":      "featurettes",
+	"behindthescenes": "behind the scenes",
+	"deleted":         "deleted scenes",
+	"interview":       "interviews",
+	"scene":           "scenes",
+	"short":           "shorts",
+}
+
 var addYearToSeries = map[string]bool{
 	"The Flash":   true,
 	"Doctor Who":  true,
@@ -17,6 +76,14 @@ var addYearToSeries = map[string]bool{
 	"Charmed":     true,
 }
 
+// placeholderEpisodeName matches the generic names TMDB hands out for untranslated episodes.
+var placeholderEpisodeName = regexp.MustCompile(`(?i)^(?:episode|folge|épisode|episodio|episódio|aflevering|odcinek|avsnitt|afsnit|jakso) \d+$|^$`)
+
+// extraMatcher matches extras like trailers. Only Plex style suffixes ("Movie-trailer"), a
+// keyword directly after the year ("Movie.2019.Trailer") or the keyword as the whole name match,
+// since titles like "The Interview" would be mistaken for extras otherwise.
+var extraMatcher = regexp.MustCompile(`(?i)(?:-|^|(?:19|20)[0-9]{2}[-._ ]+)(trailer|featurette|behind[-._ ]?the[-._ ]?scenes|deleted(?:[-._ ]?scenes?)?|interview|scene|short)s?(?:[-._ ]?[0-9]{1,2})?$`)
+
 var yearToSeasonLookup = map[string]bool{
 	"Mythbusters": true,
 }
@@ -59,15 +126,3 @@ var matchers = map[string]*regexp.Regexp{
 	"episodeAnime": regexp.MustCompile("[-_ p.](\\d{2})[-_ (v\\[](\\d{2})?"),
 	"groupAnime":   regexp.MustCompile("^(\\[\\w*\\])\\s(.*)\\s-"),
 }
-
-func initAgent() (agent *tmdb.TMDb) {
-	config := tmdb.Config{
-		APIKey:   tmdbAPIKey,
-		Proxies:  nil,
-		UseProxy: false,
-	}
-
-	agent = tmdb.Init(config)
-
-	return agent
-}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// inode is not available on Windows, files are recognized by size and modification time only.
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
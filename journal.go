@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// undoAction marks a run as undone in the journal.
+const undoAction = "undo"
+
+// undoneAction marks a single operation of a run as undone, so an undo that partially failed
+// can be finished later.
+const undoneAction = "undone"
+
+// JournalEntry is a single executed operation. Inode, Size and ModTime describe the target
+// right after the operation so undo can tell whether it changed since.
+type JournalEntry struct {
+	Run         string    `json:"run"`
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Source      string    `json:"source,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Inode       uint64    `json:"inode,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ModTime     time.Time `json:"mtime,omitempty"`
+	CreatedDirs []string  `json:"created_dirs,omitempty"`
+}
+
+// Journal appends executed operations to a JSON lines file, it is safe for concurrent use.
+type Journal struct {
+	path string
+	run  string
+	mu   sync.Mutex
+}
+
+func journalPath() string {
+	return configFolderPath("journal.jsonl")
+}
+
+// newJournal returns a journal for a new run, the run ID is based on the current time.
+func newJournal(path string) *Journal {
+	return &Journal{path: path, run: time.Now().Format("20060102-150405.000")}
+}
+
+// record appends the entry, the file is opened for every entry so the journal is complete
+// even when the run is aborted.
+func (j *Journal) record(entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if entry.Run == "" {
+		entry.Run = j.run
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordOperation records a finished operation on target.
+func (j *Journal) recordOperation(action, source, target string, createdDirs []string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	return j.record(JournalEntry{
+		Action:      action,
+		Source:      source,
+		Target:      target,
+		Inode:       inode(info),
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		CreatedDirs: createdDirs,
+	})
+}
+
+func readJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("could not read journal '%s': %s", path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// journalRun is a run as found in the journal.
+type journalRun struct {
+	ID         string
+	Operations []JournalEntry
+	Undone     bool
+}
+
+// journalRuns groups the entries by run, in the order the runs were started.
+func journalRuns(entries []JournalEntry) []*journalRun {
+	var runs []*journalRun
+	byID := make(map[string]*journalRun)
+	for _, entry := range entries {
+		run, ok := byID[entry.Run]
+		if !ok {
+			run = &journalRun{ID: entry.Run}
+			byID[entry.Run] = run
+			runs = append(runs, run)
+		}
+		if entry.Action == undoAction {
+			run.Undone = true
+		} else if entry.Action == undoneAction {
+			run.dropOperation(entry.Source, entry.Target)
+		} else {
+			run.Operations = append(run.Operations, entry)
+		}
+	}
+	return runs
+}
+
+// dropOperation removes the newest operation from source to target, it was undone already.
+func (r *journalRun) dropOperation(source, target string) {
+	for i := len(r.Operations) - 1; i >= 0; i-- {
+		if r.Operations[i].Source == source && r.Operations[i].Target == target {
+			r.Operations = append(r.Operations[:i], r.Operations[i+1:]...)
+			return
+		}
+	}
+}
+
+// missingDirs returns the folders that have to be created for dir, the deepest one last.
+func missingDirs(dir string) []string {
+	var missing []string
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		missing = append([]string{dir}, missing...)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return missing
+}
+
+// undoRun reverses all operations of the run, newest first. Operations on targets that changed
+// since the run are left alone, an error is returned when not everything could be undone.
+func undoRun(run *journalRun, journal *Journal, dryRun bool) error {
+	failed := 0
+	for i := len(run.Operations) - 1; i >= 0; i-- {
+		entry := run.Operations[i]
+		logger := log.WithFields(log.Fields{"action": entry.Action, "source": entry.Source, "target": entry.Target})
+		if err := undoOperation(entry, dryRun); err != nil {
+			logger.WithError(err).Errorln("Could not undo operation")
+			failed++
+			continue
+		}
+		if dryRun {
+			logger.Infoln("DRY-RUN: Would undo operation")
+			continue
+		}
+		logger.Infoln("Undid operation")
+		if err := journal.record(JournalEntry{Run: run.ID, Action: undoneAction, Source: entry.Source, Target: entry.Target}); err != nil {
+			logger.WithError(err).Errorln("Could not record undone operation in the journal")
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d operations of run %s could not be undone", failed, len(run.Operations), run.ID)
+	}
+	if dryRun {
+		return nil
+	}
+	return journal.record(JournalEntry{Run: run.ID, Action: undoAction})
+}
+
+func undoOperation(entry JournalEntry, dryRun bool) error {
+	info, err := os.Lstat(entry.Target)
+	if err != nil {
+		return fmt.Errorf("target is gone: %w", err)
+	}
+	if (entry.Inode != 0 && inode(info) != entry.Inode) || info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime) {
+		return fmt.Errorf("target changed since the run, not touching it")
+	}
+
+	switch entry.Action {
+	case "move", "rename":
+		if _, err := os.Lstat(entry.Source); err == nil {
+			return fmt.Errorf("source '%s' exists again, not overwriting it", entry.Source)
+		}
+		if dryRun {
+			return nil
+		}
+		if err := ensurePath(filepath.Dir(entry.Source)); err != nil {
+			return err
+		}
+		if err := moveFile(entry.Target, entry.Source); err != nil {
+			return err
+		}
+	case "symlink", "hardlink", "copy", "reflink":
+		if dryRun {
+			return nil
+		}
+		if err := os.Remove(entry.Target); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown action '%s'", entry.Action)
+	}
+
+	// Folders created by the run are only removed when they are empty again.
+	for i := len(entry.CreatedDirs) - 1; i >= 0; i-- {
+		if err := os.Remove(entry.CreatedDirs[i]); err != nil {
+			break
+		}
+	}
+	return nil
+}
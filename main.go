@@ -2,13 +2,21 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		printCommands()
+	}
 	flag.Parse()
 
 	if *logToFile {
@@ -28,6 +36,14 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	if flag.NArg() > 0 {
+		if !runCommand(flag.Args()) {
+			log.Errorf("Unknown command '%s'", flag.Arg(0))
+			flag.Usage()
+		}
+		return
+	}
+
 	if *filePath == "" {
 		log.Errorln("--filepath is a required argument.")
 		flag.PrintDefaults()
@@ -40,26 +56,145 @@ func main() {
 		return
 	}
 
+	if !validCollisionPolicy(*onCollision) || (*onCollision == "ask" && *mode != "interactive" && *mode != "tui") {
+		log.Errorf("Invalid --on-collision '%s', valid options are: largest, quality, first and ask (only with --mode=interactive or tui)", *onCollision)
+		flag.PrintDefaults()
+		return
+	}
+
+	if err := validateExecutionFlags(); err != nil {
+		log.Errorln(err)
+		flag.PrintDefaults()
+		return
+	}
+
 	var modes = map[string]bool{
 		"dry-run":     true,
 		"interactive": true,
+		"tui":         true,
 		"force":       true,
 	}
 
 	if !modes[*mode] {
-		log.Errorf("Unknown --mode '%s', valid options are: dry-run, interactive, force", *mode)
+		log.Errorf("Unknown --mode '%s', valid options are: dry-run, interactive, tui, force", *mode)
+		flag.PrintDefaults()
+		return
+	}
+
+	if *planOut != "" && *mode != "dry-run" {
+		log.Errorln("--plan-out can only be used with --mode=dry-run, use the apply command to execute the plan.")
 		flag.PrintDefaults()
 		return
 	}
 
 	if *mode == "dry-run" {
 		log.Warnln("Mode is set to dry-run, not touching files")
-	} else if *mode == "interactive" {
+	} else if *mode == "interactive" || *mode == "tui" {
 		log.Infoln("Mode is set to interactive, will prompt for confirmation")
 	} else if *mode == "force" {
 		log.Warnln("Mode is set to force, will execute without confirmation")
 	}
 
+	if _, ok := identify.SanitizeProfiles[*sanitize]; !ok {
+		log.Errorf("Unknown --sanitize '%s', valid options are: %s", *sanitize, strings.Join(identify.SanitizeProfileNames(), ", "))
+		flag.PrintDefaults()
+		return
+	}
+
+	replacements, err := identify.ParseReplacements(*sanitizeReplace)
+	if err != nil {
+		log.WithError(err).Errorln("Invalid --sanitize-replace")
+		flag.PrintDefaults()
+		return
+	}
+
+	if err := resolveFormats(); err != nil {
+		log.Errorln(err)
+		printFormatPointer(err)
+		return
+	}
+
+	cfg, err := loadConfigFile()
+	if err != nil {
+		log.WithError(err).Errorln("Could not load the configuration file")
+		printFormatPointer(err)
+		return
+	}
+
+	var localDB *identify.LocalDB
+	if *provider == "local" {
+		localDB, err = identify.OpenLocalDB(titleDBPath())
+		if err != nil {
+			log.WithError(err).Errorln("Could not open the local title database, import one with the import-titles command.")
+			return
+		}
+	} else if *provider != "tmdb" {
+		log.Errorf("Unknown --provider '%s', valid options are: tmdb, local", *provider)
+		flag.PrintDefaults()
+		return
+	}
+
+	if *tmdbLookup && localDB == nil {
+		clientOpts := identify.DefaultClientOptions()
+		clientOpts.RequestsPerSecond = *tmdbRateLimit
+		identify.ConfigureClient(clientOpts)
+	}
+
 	e := NewApp(*recursive, *action, *movieFolder, *seriesFolder, *mode, *tmdbLookup, *minFileSize, *forceMovie, *forceSeries)
+	e.movieFormat = *movieFormat
+	e.seriesFormat = *seriesFormat
+	e.specialsFormat = *specialsFormat
+	e.extrasFormat = *extrasFormat
+	e.language = *language
+	e.fallbackLanguage = *fallbackLanguage
+	e.jobs = *jobs
+	e.localDB = localDB
+	e.sanitize = *sanitize
+	e.replacements = replacements
+	e.overrides = cfg.Overrides
+	e.onCollision = *onCollision
+	e.planOut = *planOut
+	configureExecution(e, cfg)
 	e.StartRun(*filePath)
 }
+
+// validateExecutionFlags checks the flags that change how operations are executed, they are
+// used by the apply command as well.
+func validateExecutionFlags() error {
+	if !validConflictPolicy(*onConflict) {
+		return fmt.Errorf("unknown --on-conflict '%s', valid options are: %s", *onConflict, strings.Join(conflictPolicies, ", "))
+	}
+	if !reflinkFallbacks[*reflinkFallback] {
+		return fmt.Errorf("unknown --reflink-fallback '%s', valid options are: copy, hardlink, none", *reflinkFallback)
+	}
+	return nil
+}
+
+// loadConfigFile loads the file given with --config or the default configuration file.
+func loadConfigFile() (*Config, error) {
+	cfgPath := *configPath
+	if cfgPath == "" {
+		cfgPath = defaultConfigPath()
+	}
+	return loadConfig(cfgPath, *configPath != "")
+}
+
+// configureExecution sets everything that changes how operations are executed from the flags
+// and the configuration file.
+func configureExecution(e *App, cfg *Config) {
+	e.onConflict = *onConflict
+	e.upgrade = *upgrade
+	e.qualityRanking = cfg.QualityRanking
+	e.trash = *trashFolder
+	e.verifyCopies = *verifyCopies
+	e.reflinkFallback = *reflinkFallback
+	e.cleanup = *cleanup
+	e.hooks = cfg.Hooks
+	e.mediaServers = cfg.MediaServers
+	if cfg.CleanupJunk != nil {
+		e.junk = cfg.CleanupJunk
+	}
+	if e.mode != "dry-run" {
+		e.journal = newJournal(journalPath())
+	}
+}
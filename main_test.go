@@ -1,22 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/olaris/olaris-rename/identify"
 )
 
+var network = flag.Bool("network", false, "Run the tests that need the TMDB API.")
+
 func TestSmallFile(t *testing.T) {
 	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
 	defer os.RemoveAll(tmpdir)
 
 	fmt.Println(tmpdir)
-	e := NewApp(true, "symlink", tmpdir, tmpdir, false, true, "120", false, false)
+	e := NewApp(true, "symlink", tmpdir, tmpdir, "force", true, "120", false, false)
 	e.StartRun(filepath.Join("test-files", "The.Matrix-1999.mkv"))
 	if err != nil {
 		t.Error(err)
@@ -44,7 +57,7 @@ func TestRecursive(t *testing.T) {
 	}
 
 	f := identify.NewParsedFile(tf)
-	err = act(f, tmpdir, "symlink")
+	err = performIn(f, tmpdir, "symlink")
 	if err != nil {
 		t.Error(err)
 	}
@@ -66,7 +79,7 @@ func TestSymlink(t *testing.T) {
 	}
 
 	f := identify.NewParsedFile(filepath.Join(tmpdir, "Angel.S04E02.mkv"))
-	err = act(f, tmpdir, "symlink")
+	err = performIn(f, tmpdir, "symlink")
 	if err != nil {
 		t.Error(err)
 	}
@@ -88,7 +101,7 @@ func TestCopy(t *testing.T) {
 	}
 
 	f := identify.NewParsedFile(filepath.Join(tmpdir, name))
-	err = act(f, tmpdir, "copy")
+	err = performIn(f, tmpdir, "copy")
 	if err != nil {
 		t.Error(err)
 	}
@@ -111,6 +124,13 @@ func createFile(fileName string) error {
 	return nil
 }
 
+// performIn acts on the file with the given action, its target is relative to folder.
+func performIn(f identify.ParsedFile, folder, action string) error {
+	e := NewApp(false, action, folder, folder, "force", false, "0", false, false)
+	_, _, err := e.perform(PlannedOperation{SourcePath: f.SourcePath(), TargetPath: filepath.Join(folder, f.TargetName()), File: f})
+	return err
+}
+
 func stageTestFolder(fileName string) (string, error) {
 	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
 
@@ -131,7 +151,7 @@ func TestMove(t *testing.T) {
 	}
 
 	f := identify.NewParsedFile(filepath.Join(tmpdir, name))
-	err = act(f, tmpdir, "move")
+	err = performIn(f, tmpdir, "move")
 	if err != nil {
 		t.Error(err)
 	}
@@ -143,11 +163,14 @@ func TestMove(t *testing.T) {
 	}
 }
 func TestLookup(t *testing.T) {
+	if !*network {
+		t.Skip("Needs the TMDB API, run with -network")
+	}
 	log.SetLevel(log.DebugLevel)
 	moreTests := make(map[string]identify.ParsedFile)
 	opts := identify.GetDefaultOptions()
 
-	moreTests["The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv"] = identify.ParsedFile{Options: opts, Filename: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA", Extension: ".mkv", Filepath: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv", Year: "2014", IsMovie: false, IsSeries: true, CleanName: "The Flash (2014)", Season: "06", Episode: "07", Resolution: "720p"}
+	moreTests["The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv"] = identify.ParsedFile{Options: opts, Filename: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA", TechnicalInfo: "720p.HDTV.x264-SVA", Extension: ".mkv", Filepath: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv", Year: "2014", IsMovie: false, IsSeries: true, CleanName: "The Flash (2014)", Season: "06", Episode: "07", Resolution: "720p"}
 	moreTests["Charmed.1998.S01E01.mkv"] = identify.ParsedFile{Options: opts, Filename: "Charmed.1998.S01E01", Extension: ".mkv", Filepath: "Charmed.1998.S01E01.mkv", Year: "1998", IsMovie: false, IsSeries: true, CleanName: "Charmed (1998)", Season: "01", Episode: "01", Resolution: ""}
 	moreTests["Charmed.2018.S01E01.mkv"] = identify.ParsedFile{Options: opts, Filename: "Charmed.2018.S01E01", Extension: ".mkv", Filepath: "Charmed.2018.S01E01.mkv", Year: "2018", IsMovie: false, IsSeries: true, CleanName: "Charmed (2018)", Season: "01", Episode: "01", Resolution: ""}
 	moreTests["Maleficent.Mistress.of.Evil.2019.720p.BluRay.x264-SPARKS.mkv"] = identify.ParsedFile{Options: opts, Filename: "Maleficent.Mistress.of.Evil.2019.720p.BluRay.x264-SPARKS", Extension: ".mkv", Filepath: "Maleficent.Mistress.of.Evil.2019.720p.BluRay.x264-SPARKS.mkv", Year: "2019", IsMovie: true, IsSeries: false, CleanName: "Maleficent Mistress of Evil", Season: "", Episode: "", Resolution: "720p"}
@@ -234,13 +257,13 @@ func TestParseContent(t *testing.T) {
 	tests["Angel.S04E12.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "Angel.S04E12", Extension: ".mkv", Filepath: "Angel.S04E12.mkv", Year: "", IsSeries: true, CleanName: "Angel", Season: "04", Episode: "12"}
 	// Mythbusters uses a weird format where the seasonname is the year it was aired.
 	tests["Mythbusters.S2005E03.Brown.Note.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "Mythbusters.S2005E03.Brown.Note", Extension: ".mkv", Filepath: "Mythbusters.S2005E03.Brown.Note.mkv", Year: "", IsSeries: true, CleanName: "Mythbusters", Season: "2005", Episode: "03"}
-	tests["Downton Abbey 5x06 HDTV x264-FoV [eztv].mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Extension: ".mkv", IsSeries: true, Filename: "Downton Abbey 5x06 HDTV x264-FoV [eztv]", Season: "05", Episode: "06", CleanName: "Downton Abbey", Filepath: "Downton Abbey 5x06 HDTV x264-FoV [eztv].mkv"}
+	tests["Downton Abbey 5x06 HDTV x264-FoV [eztv].mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Extension: ".mkv", IsSeries: true, Filename: "Downton Abbey 5x06 HDTV x264-FoV [eztv]", TechnicalInfo: "HDTV x264-FoV [eztv]", Season: "05", Episode: "06", CleanName: "Downton Abbey", Filepath: "Downton Abbey 5x06 HDTV x264-FoV [eztv].mkv"}
 	tests["Weekend.At.Bernie's.1989.1080p.BluRay.FLAC2.0.x264-DON.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "Weekend.At.Bernie's.1989.1080p.BluRay.FLAC2.0.x264-DON", Extension: ".mkv", Filepath: "Weekend.At.Bernie's.1989.1080p.BluRay.FLAC2.0.x264-DON.mkv", Resolution: "1080p", Year: "1989", IsSeries: false, IsMovie: true, CleanName: "Weekend At Bernie's"}
-	tests["[HorribleSubs] Kaiji S2 - Against All Rules - 01 [480p].mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "[HorribleSubs] Kaiji S2 - Against All Rules - 01 [480p]", Extension: ".mkv", Filepath: "[HorribleSubs] Kaiji S2 - Against All Rules - 01 [480p].mkv", Year: "", IsSeries: true, CleanName: "Kaiji S2 - Against All Rules", Season: "00", Episode: "01", Resolution: "480p"}
-	tests["[HorribleSubs] Fruits Basket (2019) - 01 [1080p].mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "[HorribleSubs] Fruits Basket (2019) - 01 [1080p]", Extension: ".mkv", Filepath: "[HorribleSubs] Fruits Basket (2019) - 01 [1080p].mkv", Year: "2019", IsSeries: true, CleanName: "Fruits Basket", Season: "00", Episode: "01", Resolution: "1080p"}
+	tests["[HorribleSubs] Kaiji S2 - Against All Rules - 01 [480p].mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "[HorribleSubs] Kaiji S2 - Against All Rules - 01 [480p]", TechnicalInfo: "[480p]", Extension: ".mkv", Filepath: "[HorribleSubs] Kaiji S2 - Against All Rules - 01 [480p].mkv", Year: "", IsSeries: true, CleanName: "Kaiji S2 - Against All Rules", Season: "00", Episode: "01", Resolution: "480p"}
+	tests["[HorribleSubs] Fruits Basket (2019) - 01 [1080p].mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "[HorribleSubs] Fruits Basket (2019) - 01 [1080p]", TechnicalInfo: "[1080p]", Extension: ".mkv", Filepath: "[HorribleSubs] Fruits Basket (2019) - 01 [1080p].mkv", Year: "2019", IsSeries: true, CleanName: "Fruits Basket", Season: "00", Episode: "01", Resolution: "1080p"}
 	tests["Apollo.11.2019.1080p.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "Apollo.11.2019.1080p", Extension: ".mkv", Filepath: "Apollo.11.2019.1080p.mkv", Year: "2019", IsMovie: true, IsSeries: false, CleanName: "Apollo 11", Season: "", Episode: "", Resolution: "1080p"}
-	tests["The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA", Extension: ".mkv", Filepath: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv", Year: "2014", IsMovie: false, IsSeries: true, CleanName: "The Flash (2014)", Season: "06", Episode: "07", Resolution: "720p"}
-	tests["/home/test/The.Flash.2014.S06E07.720p.HDTV.x264-SVA/jioasdjioasd9012.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA", Extension: ".mkv", Filepath: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv", Year: "2014", IsMovie: false, IsSeries: true, CleanName: "The Flash (2014)", Season: "06", Episode: "07", Resolution: "720p"}
+	tests["The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA", TechnicalInfo: "720p.HDTV.x264-SVA", Extension: ".mkv", Filepath: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv", Year: "2014", IsMovie: false, IsSeries: true, CleanName: "The Flash (2014)", Season: "06", Episode: "07", Resolution: "720p"}
+	tests["/home/test/The.Flash.2014.S06E07.720p.HDTV.x264-SVA/jioasdjioasd9012.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA", TechnicalInfo: "720p.HDTV.x264-SVA", Extension: ".mkv", Filepath: "The.Flash.2014.S06E07.720p.HDTV.x264-SVA.mkv", Year: "2014", IsMovie: false, IsSeries: true, CleanName: "The Flash (2014)", Season: "06", Episode: "07", Resolution: "720p"}
 	tests["/home/test/letsnotrecurse.mkv"] = identify.ParsedFile{Options: identify.GetDefaultOptions(), Filename: "test", Extension: ".mkv", Filepath: "test.mkv", Year: "", IsMovie: false, IsSeries: false, CleanName: "Test", Season: "", Episode: "", Resolution: ""}
 
 	for name, mi := range tests {
@@ -291,3 +314,1561 @@ func TestParseContent(t *testing.T) {
 	}
 
 }
+
+func TestOriginalTitleToken(t *testing.T) {
+	opts := identify.GetDefaultOptions()
+	opts.MovieFormat = "{original_title} ({y})/{n} ({y})"
+	f := identify.NewParsedFile("Das.Boot.1981.mkv", opts)
+	if target := f.TargetName(); target != "Das Boot (1981)/Das Boot (1981).mkv" {
+		t.Errorf("Expected {original_title} to fall back to the clean name without lookup, got '%s'", target)
+	}
+
+	f.CleanName = "The Boat"
+	f.OriginalTitle = "Das Boot"
+	if target := f.TargetName(); target != "Das Boot (1981)/The Boat (1981).mkv" {
+		t.Errorf("Expected {original_title} to use the original title, got '%s'", target)
+	}
+}
+
+func TestLookupRetriesRateLimitedRequests(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"results": [{"id": 603, "title": "The Matrix", "original_title": "The Matrix"}]}`)
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, Backoff: time.Millisecond})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	f := identify.NewParsedFile("The.Matrix.1999.mkv", identify.Options{Lookup: true})
+	if f.LookupFailed {
+		t.Error("Expected lookup to succeed after retrying")
+	}
+	if f.ExternalID != 603 {
+		t.Errorf("Expected ExternalID 603 but got %d", f.ExternalID)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 requests but got %d", n)
+	}
+}
+
+func TestLookupMalformedResponses(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// A Retry-After of an hour must not stall the run.
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"results": [`)
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, MaxBackoff: time.Millisecond, BreakerThreshold: 1})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	for i := 0; i < 2; i++ {
+		if f := identify.NewParsedFile("The.Matrix.1999.mkv", identify.Options{Lookup: true}); f.LookupFailed {
+			t.Error("Expected a malformed response not to mark the file as lookup-failed")
+		}
+	}
+	// One rate limited request, then a single request per lookup without retries.
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("Expected 3 requests but got %d", n)
+	}
+}
+
+func TestLookupFailedFilesAreHeldBack(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, MaxRetries: 1, Backoff: -1, BreakerThreshold: 1})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	f := identify.NewParsedFile("The.Matrix.1999.mkv", identify.Options{Lookup: true})
+	if !f.LookupFailed {
+		t.Error("Expected file to be marked as lookup-failed")
+	}
+
+	// The breaker is open now so the next lookup should not hit the server at all.
+	before := atomic.LoadInt32(&calls)
+	tmpdir, err := stageTestFolder("Angel.S04E02.mkv")
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewApp(true, "symlink", tmpdir, tmpdir, "force", true, "0", false, false)
+	if ops := e.collectFileOperations(filepath.Join(tmpdir, "Angel.S04E02.mkv")); len(ops) != 0 {
+		t.Errorf("Expected lookup-failed file to be held back, got %d operations", len(ops))
+	}
+	if n := atomic.LoadInt32(&calls); n != before {
+		t.Errorf("Expected the circuit breaker to stop requests, got %d new requests", n-before)
+	}
+}
+
+func TestEpisodeNameLookupFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/episode/") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"results": [{"id": 2426, "name": "Angel", "original_name": "Angel", "first_air_date": "1999-10-05"}]}`)
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, MaxRetries: -1})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	f := identify.NewParsedFile("Angel.S04E02.mkv", identify.Options{Lookup: true})
+	if !f.LookupFailed {
+		t.Errorf("Expected a failed episode lookup to mark the file as lookup-failed, got name '%s'", f.EpisodeName)
+	}
+}
+
+func TestFallbackLanguage(t *testing.T) {
+	var episodeCalls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		english := r.URL.Query().Get("language") == "en-US"
+		if strings.Contains(r.URL.Path, "/episode/") {
+			atomic.AddInt32(&episodeCalls, 1)
+		}
+		switch {
+		case r.URL.Path == "/search/tv":
+			fmt.Fprint(w, `{"results": [{"id": 71446, "name": "", "original_name": "La casa de papel", "first_air_date": "2017-05-02"}]}`)
+		case r.URL.Path == "/tv/71446" && english:
+			fmt.Fprint(w, `{"id": 71446, "name": "Money Heist"}`)
+		case r.URL.Path == "/tv/71446/season/1/episode/1" && english:
+			fmt.Fprint(w, `{"name": "Do as Planned"}`)
+		case r.URL.Path == "/tv/71446/season/1/episode/1":
+			fmt.Fprint(w, `{"name": "Episode 1"}`)
+		case r.URL.Path == "/search/movie":
+			fmt.Fprint(w, `{"results": [{"id": 194, "title": "", "original_title": "Le Fabuleux Destin d'Amélie Poulain"}]}`)
+		case r.URL.Path == "/movie/194":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, MaxRetries: -1})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	f := identify.NewParsedFile("La.Casa.de.Papel.S01E01.mkv", identify.Options{Lookup: true, Language: "nl-NL", FallbackLanguage: "en-US"})
+	if f.CleanName != "Money Heist" || f.EpisodeName != "Do as Planned" {
+		t.Errorf("Expected the show and episode name in the fallback language, got '%s' and '%s'", f.CleanName, f.EpisodeName)
+	}
+
+	// Without --language TMDB already answers in en-US, asking again would get the same answer.
+	before := atomic.LoadInt32(&episodeCalls)
+	identify.NewParsedFile("La.Casa.de.Papel.S01E01.mkv", identify.Options{Lookup: true, FallbackLanguage: "en-US"})
+	if n := atomic.LoadInt32(&episodeCalls) - before; n != 1 {
+		t.Errorf("Expected a single episode request without --language, got %d", n)
+	}
+
+	// The original title is no replacement for a title the provider could not give.
+	f = identify.NewParsedFile("Le.Fabuleux.Destin.d.Amelie.Poulain.2001.mkv", identify.Options{Lookup: true, Language: "nl-NL", FallbackLanguage: "en-US"})
+	if !f.LookupFailed {
+		t.Errorf("Expected a failed fallback lookup to mark the file as lookup-failed, got '%s'", f.CleanName)
+	}
+}
+
+func TestConcurrentPlanIsDeterministic(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Angel.S04E02.mkv", "Angel.S04E01.mkv", "Apollo.11.2019.1080p.mkv", "Downton Abbey 5x06 HDTV x264-FoV [eztv].mkv", "The.Matrix.1999.mkv"} {
+		if err := createFile(filepath.Join(tmpdir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var plans [][]PlannedOperation
+	for _, jobs := range []int{1, 8} {
+		e := NewApp(true, "symlink", tmpdir, tmpdir, "dry-run", false, "0", false, false)
+		e.jobs = jobs
+		ops, err := e.collectPlannedOperations(tmpdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plans = append(plans, ops)
+	}
+
+	if len(plans[0]) != 5 || len(plans[0]) != len(plans[1]) {
+		t.Fatalf("Expected 5 operations for every amount of jobs, got %d and %d", len(plans[0]), len(plans[1]))
+	}
+	for i := range plans[0] {
+		if plans[0][i].TargetPath != plans[1][i].TargetPath {
+			t.Errorf("Expected plan order to be stable, got '%s' and '%s' at %d", plans[0][i].TargetPath, plans[1][i].TargetPath, i)
+		}
+		if i > 0 && plans[0][i-1].SourcePath > plans[0][i].SourcePath {
+			t.Errorf("Expected plan to be sorted by source, '%s' came before '%s'", plans[0][i-1].SourcePath, plans[0][i].SourcePath)
+		}
+	}
+}
+
+func TestLocalTitleDatabase(t *testing.T) {
+	db := &identify.LocalDB{}
+	export := `{"adult":false,"id":603,"original_title":"The Matrix","popularity":60.2,"video":false}
+{"adult":false,"id":604,"original_title":"The Matrix Reloaded","popularity":30.1,"video":false}
+{"adult":false,"id":3924,"original_title":"Blondie","popularity":2.8,"video":false}`
+	if n, err := db.Import(strings.NewReader(export), ""); err != nil || n != 3 {
+		t.Fatalf("Expected 3 imported titles, got %d (%v)", n, err)
+	}
+	catalog := "id,title,original_title,year,type\n1399,Game of Thrones,,2011,tv\n1405,Dexter,,2006,tv\n"
+	if n, err := db.Import(strings.NewReader(catalog), ""); err != nil || n != 2 {
+		t.Fatalf("Expected 2 imported titles, got %d (%v)", n, err)
+	}
+
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmpdir, "titles.json")
+	if err := db.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err = identify.OpenLocalDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := identify.NewParsedFile("The.Matrix.1999.1080p.mkv", identify.Options{Lookup: true, LocalDB: db})
+	if f.ExternalID != 603 || f.CleanName != "The Matrix" {
+		t.Errorf("Expected The Matrix (603) but got '%s' (%d)", f.CleanName, f.ExternalID)
+	}
+
+	// Words no title has must not push the real ones out of the search.
+	if c, ok := db.SearchMovie("The Matrix Directors Cut", ""); !ok || c.ID != 603 {
+		t.Errorf("Expected The Matrix (603) for a name with extra words but got '%s' (%d)", c.Title, c.ID)
+	}
+
+	f = identify.NewParsedFile("Game.of.Thrones.S01E01.mkv", identify.Options{Lookup: true, LocalDB: db})
+	if f.ExternalID != 1399 || f.Year != "2011" {
+		t.Errorf("Expected Game of Thrones (1399) from 2011 but got '%s' (%d) from '%s'", f.CleanName, f.ExternalID, f.Year)
+	}
+
+	f = identify.NewParsedFile("Some.Unknown.Movie.2001.mkv", identify.Options{Lookup: true, LocalDB: db})
+	if f.ExternalID != 0 || f.CleanName != "Some Unknown Movie" {
+		t.Errorf("Expected no match for an unknown movie but got '%s' (%d)", f.CleanName, f.ExternalID)
+	}
+}
+
+func TestFormatRendering(t *testing.T) {
+	values := map[string]string{"n": "Angel", "s": "04", "e": "02", "t": "", "y": "", "r": "720p", "i": ""}
+	value := func(token string) string { return values[token] }
+
+	tests := map[string]string{
+		identify.DefaultSeriesFormat:      "Angel/Season 04/Angel - S04E02",
+		identify.DefaultMovieFormat:       "Angel/Angel 720p",
+		"{n}< ({y})>/{n}< ({y})>< - {t}>": "Angel/Angel",
+		"{n}< ({y})> [{r}]":               "Angel [720p]",
+		"{n}.S{s}E{e}.{t}.{y}":            "Angel.S04E02",
+		"{n} {{{r}}} <<{s}>>":             "Angel {720p} <04>",
+		"{n}<.S{s}<E{e}>>":                "Angel.S04E02",
+		"{n} - {t} - {y} - S{s}E{e}":      "Angel - S04E02",
+		"<{t}/>{n}":                       "Angel",
+		"{n} <{i}>{r}":                    "Angel 720p",
+	}
+	for format, expected := range tests {
+		f, err := identify.ParseFormat(format)
+		if err != nil {
+			t.Errorf("Could not parse '%s': %s", format, err)
+			continue
+		}
+		if got := f.Render(value); got != expected {
+			t.Errorf("Format '%s' rendered as '%s', expected '%s'", format, got, expected)
+		}
+	}
+
+	for _, format := range []string{"{n", "{n}}", "{n}<{y}", "{n}>", "{ss}"} {
+		if _, err := identify.ParseFormat(format); err == nil {
+			t.Errorf("Expected format '%s' to be rejected", format)
+		}
+	}
+}
+
+func TestFormatModifiers(t *testing.T) {
+	values := map[string]string{"n": "The Café Ærø", "s": "04", "e": "1", "t": "A Very Long Episode Title That Goes On And On"}
+	value := func(token string) string { return values[token] }
+
+	tests := map[string]string{
+		"{n} S{s:01}E{e:03}": "The Café Ærø S4E001",
+		"{n:lower}":          "the café ærø",
+		"{n:upper}":          "THE CAFÉ ÆRØ",
+		"{n:sort}":           "Café Ærø, The",
+		"{n:ascii}":          "The Cafe AEro",
+		"{n:sort:ascii}":     "Cafe AEro, The",
+		"{t:20}":             "A Very Long Episode",
+		"{t:lower:title}":    "A Very Long Episode Title That Goes On And On",
+		"{y:04}<({y:04})>":   "",
+	}
+	for format, expected := range tests {
+		f, err := identify.ParseFormat(format)
+		if err != nil {
+			t.Errorf("Could not parse '%s': %s", format, err)
+			continue
+		}
+		if got := f.Render(value); got != expected {
+			t.Errorf("Format '%s' rendered as '%s', expected '%s'", format, got, expected)
+		}
+	}
+
+	if _, err := identify.ParseFormat("{n:shout}"); err == nil {
+		t.Error("Expected unknown modifier to be rejected")
+	}
+}
+
+func TestSanitizeProfiles(t *testing.T) {
+	opts := identify.GetDefaultOptions()
+	opts.SeriesFormat = "{n}/{n} - S{s}E{e} - {t}"
+	f := identify.NewParsedFile("Angel.S04E02.mkv", opts)
+	f.CleanName = "Con"
+	f.EpisodeName = "Who's <Afraid>? AC/DC | \"Live\"..."
+
+	if target := f.TargetName(); target != "Con/Con - S04E02 - Who's <Afraid>? AC-DC | \"Live\".mkv" {
+		t.Errorf("Unexpected posix target '%s'", target)
+	}
+
+	// Shares and FAT32 drives follow the Windows rules.
+	for _, profile := range []string{"windows", "smb", "fat32"} {
+		f.Options.Sanitize = profile
+		if target := f.TargetName(); target != "Con_/Con - S04E02 - Who's Afraid AC-DC - 'Live'.mkv" {
+			t.Errorf("Unexpected %s target '%s'", profile, target)
+		}
+	}
+
+	f.Options.Sanitize = "windows"
+	f.Options.Replacements = map[string]string{"|": "and", "?": "!"}
+	if target := f.TargetName(); target != "Con_/Con - S04E02 - Who's Afraid! AC-DC and 'Live'.mkv" {
+		t.Errorf("Unexpected windows target with replacements '%s'", target)
+	}
+}
+
+func TestSanitizeLongNames(t *testing.T) {
+	f := identify.NewParsedFile("Angel.S04E02.mkv")
+	f.EpisodeName = strings.Repeat("Very Long Title ", 30)
+	target := f.TargetName()
+	name := filepath.Base(target)
+	if len(name) > 255 {
+		t.Errorf("Expected name to be at most 255 bytes, got %d", len(name))
+	}
+	if !strings.HasPrefix(name, "Angel - S04E02 - Very Long Title") || !strings.HasSuffix(name, ".mkv") {
+		t.Errorf("Expected the episode markers and extension to be kept, got '%s'", name)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	plex := identify.Presets["plex"]
+	opts := identify.GetDefaultOptions()
+	opts.MovieFormat = plex.MovieFormat
+	opts.SeriesFormat = plex.SeriesFormat
+	opts.SpecialsFormat = plex.SpecialsFormat
+	opts.ExtrasFormat = plex.ExtrasFormat
+
+	movie := identify.NewParsedFile("The.Matrix.1999.1080p.BluRay.x264.mkv", opts)
+	movie.ExternalID = 603
+	if target := movie.TargetName(); target != "The Matrix (1999) {tmdb-603}/The Matrix (1999).mkv" {
+		t.Errorf("Unexpected plex movie target '%s'", target)
+	}
+	movie.ExternalID = 0
+	if target := movie.TargetName(); target != "The Matrix (1999)/The Matrix (1999).mkv" {
+		t.Errorf("Expected no tmdb tag without an ID, got '%s'", target)
+	}
+
+	special := identify.NewParsedFile("Doctor.Who.S00E01.mkv", opts)
+	if target := special.TargetName(); target != "Doctor Who/Specials/Doctor Who - s00e01.mkv" {
+		t.Errorf("Unexpected plex special target '%s'", target)
+	}
+
+	trailer := identify.NewParsedFile("The.Matrix.1999.Trailer.mkv", opts)
+	if trailer.ExtraType != "trailer" {
+		t.Errorf("Expected a trailer, got '%s'", trailer.ExtraType)
+	}
+	if target := trailer.TargetName(); target != "The Matrix (1999)/The.Matrix.1999.Trailer-trailer.mkv" {
+		t.Errorf("Unexpected plex trailer target '%s'", target)
+	}
+
+	if identify.IsExtra("The.Interview.2014.1080p.mkv") || identify.IsExtra("The.Big.Short.2015.mkv") {
+		t.Errorf("Titles containing extra keywords should not be extras")
+	}
+
+	// Small extras only get past --min-file-size when they have a format of their own.
+	tmpdir, err := stageTestFolder("The.Matrix.1999.Trailer.mkv")
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewApp(true, "symlink", tmpdir, tmpdir, "dry-run", false, "1", false, false)
+	if ops := e.collectFileOperations(filepath.Join(tmpdir, "The.Matrix.1999.Trailer.mkv")); len(ops) != 0 {
+		t.Errorf("Expected a small extra to be skipped without an extras format, got %+v", ops)
+	}
+	e.extrasFormat = plex.ExtrasFormat
+	if ops := e.collectFileOperations(filepath.Join(tmpdir, "The.Matrix.1999.Trailer.mkv")); len(ops) != 1 {
+		t.Errorf("Expected a small extra to be kept with an extras format, got %d operations", len(ops))
+	}
+}
+
+func TestMetadataTokens(t *testing.T) {
+	var detailCalls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search/movie":
+			fmt.Fprint(w, `{"results": [{"id": 603, "title": "The Matrix", "original_title": "The Matrix"}]}`)
+		case "/movie/603":
+			atomic.AddInt32(&detailCalls, 1)
+			fmt.Fprint(w, `{"id": 603, "title": "The Matrix", "runtime": 136,
+				"genres": [{"id": 28, "name": "Action"}, {"id": 878, "name": "Science Fiction"}],
+				"belongs_to_collection": {"id": 2344, "name": "The Matrix Collection"},
+				"production_countries": [{"iso_3166_1": "US", "name": "United States of America"}],
+				"releases": {"countries": [{"iso_3166_1": "DE", "certification": "16"}, {"iso_3166_1": "US", "certification": "R"}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, Backoff: time.Millisecond})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	opts := identify.Options{Lookup: true, MovieFormat: "{genre}/{letter}/<{collection}/>{n} ({y}) [{country} {cert}]"}
+	f := identify.NewParsedFile("The.Matrix.1999.mkv", opts)
+	if target := f.TargetName(); target != "Action/M/The Matrix Collection/The Matrix (1999) [US R].mkv" {
+		t.Errorf("Unexpected target with metadata tokens '%s'", target)
+	}
+	if f.Runtime != 136 || len(f.Genres) != 2 {
+		t.Errorf("Expected runtime and genres to be set, got %d and %v", f.Runtime, f.Genres)
+	}
+
+	opts.Language = "de-DE"
+	if f := identify.NewParsedFile("The.Matrix.1999.mkv", opts); f.Certification != "16" {
+		t.Errorf("Expected the certification of the language region, got '%s'", f.Certification)
+	}
+
+	before := atomic.LoadInt32(&detailCalls)
+	identify.NewParsedFile("The.Matrix.1999.mkv", identify.Options{Lookup: true})
+	if n := atomic.LoadInt32(&detailCalls); n != before {
+		t.Errorf("Expected no details request when the format does not need them, got %d", n-before)
+	}
+
+	opts.Lookup = false
+	f = identify.NewParsedFile("The.Matrix.1999.mkv", opts)
+	if target := f.TargetName(); target != "Unknown/M/The Matrix (1999).mkv" {
+		t.Errorf("Unexpected fallback target without lookup '%s'", target)
+	}
+}
+
+func TestExternalIDTokens(t *testing.T) {
+	var idCalls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search/tv":
+			fmt.Fprint(w, `{"results": [{"id": 1399, "name": "Game of Thrones", "original_name": "Game of Thrones", "first_air_date": "2011-04-17"}]}`)
+		case "/tv/1399/external_ids":
+			atomic.AddInt32(&idCalls, 1)
+			fmt.Fprint(w, `{"id": 1399, "imdb_id": "tt0944947", "tvdb_id": 121361}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, Backoff: time.Millisecond})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	opts := identify.Options{Lookup: true, SeriesFormat: "{n} {{tmdb-{tmdbid}}} {{imdb-{imdbid}}} [tvdbid-{tvdbid}]/{n} - S{s}E{e}"}
+	f := identify.NewParsedFile("Game.of.Thrones.S01E01.mkv", opts)
+	if target := f.TargetName(); target != "Game of Thrones {tmdb-1399} {imdb-tt0944947} [tvdbid-121361]/Game of Thrones - S01E01.mkv" {
+		t.Errorf("Unexpected target with external IDs '%s'", target)
+	}
+
+	before := atomic.LoadInt32(&idCalls)
+	identify.NewParsedFile("Game.of.Thrones.S01E01.mkv", identify.Options{Lookup: true, SeriesFormat: "{n} {{tmdb-{tmdbid}}}/{n} - S{s}E{e}"})
+	if n := atomic.LoadInt32(&idCalls); n != before {
+		t.Errorf("Expected no external IDs request when the format does not need them, got %d", n-before)
+	}
+
+	opts.Lookup = false
+	f = identify.NewParsedFile("Game.of.Thrones.S01E01.mkv", opts)
+	if target := f.TargetName(); target != "Game Of Thrones/Game Of Thrones - S01E01.mkv" {
+		t.Errorf("Expected unknown IDs to leave no empty tags, got '%s'", target)
+	}
+}
+
+func TestFormatValidation(t *testing.T) {
+	_, err := identify.ParseFormat("{n}/Season {ss}/{n}")
+	if err == nil || !strings.Contains(err.Error(), "did you mean '{s}'") || !strings.Contains(err.Error(), "position 12") {
+		t.Errorf("Expected an unknown token error with a suggestion, got %v", err)
+	}
+	if _, err := identify.ParseFormat("{n}/{n} ({y}"); err != nil {
+		t.Errorf("Expected unbalanced parentheses to be fine, got %v", err)
+	}
+	if _, err := identify.ParseFormat("{n}/{n} {y"); err == nil {
+		t.Error("Expected an unclosed brace to be rejected")
+	}
+
+	for _, name := range identify.SampleNames {
+		if f := identify.NewParsedFile(name); !f.IsMovie && !f.IsSeries {
+			t.Errorf("Expected sample '%s' to be identified as movie or series", name)
+		}
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	tmpdir, err := stageTestFolder("[HorribleSubs] Fruits Basket (2019) - 05 [1080p].mkv")
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := filepath.Join(tmpdir, "docs")
+	os.Mkdir(docs, 0755)
+	createFile(filepath.Join(docs, "Planet.Earth.S01E02.mkv"))
+	createFile(filepath.Join(tmpdir, "Angel.S04E02.mkv"))
+
+	configFile := filepath.Join(tmpdir, "config.json")
+	config := `{"overrides": [
+		{"name": "fruits basket", "season": 1, "series_format": "{n}/{n} - {e:03}", "target_folder": "` + filepath.Join(tmpdir, "anime") + `"},
+		{"folder": "` + docs + `", "series_format": "{n}/{n} {s}x{e}", "episode_offset": 10}
+	]}`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(configFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewApp(true, "symlink", filepath.Join(tmpdir, "movies"), filepath.Join(tmpdir, "series"), "force", false, "0", false, false)
+	e.overrides = cfg.Overrides
+	ops, err := e.collectPlannedOperations(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := make(map[string]bool)
+	for _, op := range ops {
+		targets[op.TargetPath] = true
+	}
+	for _, want := range []string{
+		filepath.Join(tmpdir, "anime", "Fruits Basket", "Fruits Basket - 005.mkv"),
+		filepath.Join(tmpdir, "series", "Planet Earth", "Planet Earth 01x12.mkv"),
+		filepath.Join(tmpdir, "series", "Angel", "Season 04", "Angel - S04E02.mkv"),
+	} {
+		if !targets[want] {
+			t.Errorf("Expected target '%s' in %v", want, targets)
+		}
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte(`{"overrides": [{"name": "Angel", "series_format": "{n}/{ss}"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(configFile, true); err == nil {
+		t.Error("Expected an override with an invalid format to be rejected")
+	}
+}
+
+func TestOverrideEpisodeNames(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search/tv":
+			fmt.Fprint(w, `{"results": [{"id": 88040, "name": "Fruits Basket", "original_name": "Fruits Basket", "first_air_date": "2019-04-06"}]}`)
+		case "/tv/88040/season/0/episode/5":
+			fmt.Fprint(w, `{"name": "Some Special"}`)
+		case "/tv/88040/season/1/episode/5":
+			fmt.Fprint(w, `{"name": "Let's Go Home"}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer ts.Close()
+	identify.ConfigureClient(identify.ClientOptions{BaseURL: ts.URL, MaxRetries: -1})
+	defer identify.ConfigureClient(identify.DefaultClientOptions())
+
+	tmpdir, err := stageTestFolder("[HorribleSubs] Fruits Basket (2019) - 05 [1080p].mkv")
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	season := 1
+	e := NewApp(true, "symlink", tmpdir, tmpdir, "dry-run", true, "0", false, false)
+	e.overrides = []Override{{Name: "Fruits Basket", Season: &season, SeriesFormat: "{n}/{n} - S{s}E{e} - {t}"}}
+	ops, err := e.collectPlannedOperations(tmpdir)
+	if err != nil || len(ops) != 1 {
+		t.Fatalf("Expected one operation, got %d (%v)", len(ops), err)
+	}
+	if want := filepath.Join(tmpdir, "Fruits Basket", "Fruits Basket - S01E05 - Let's Go Home.mkv"); ops[0].TargetPath != want {
+		t.Errorf("Expected the episode name of the new numbering, got '%s'", ops[0].TargetPath)
+	}
+}
+
+func TestJournalUndo(t *testing.T) {
+	name := "Angel.S04E02.mkv"
+	tmpdir, err := stageTestFolder(name)
+	defer os.RemoveAll(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(tmpdir, name)
+	series := filepath.Join(tmpdir, "series")
+	journalFile := filepath.Join(tmpdir, "journal.jsonl")
+
+	e := NewApp(true, "move", series, series, "force", false, "0", false, false)
+	e.journal = newJournal(journalFile)
+	ops := e.collectFileOperations(source)
+	e.executeOperations(ops)
+
+	target := filepath.Join(series, "Angel", "Season 04", "Angel - S04E02.mkv")
+	if _, err := os.Stat(target); err != nil {
+		t.Fatalf("Expected file to be moved: %s", err)
+	}
+	entries, err := readJournal(journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Source != source || entries[0].Target != target || len(entries[0].CreatedDirs) != 3 {
+		t.Fatalf("Unexpected journal entries %+v", entries)
+	}
+
+	runs := journalRuns(entries)
+	if err := undoRun(runs[0], newJournal(journalFile), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(source); err != nil {
+		t.Errorf("Expected file to be moved back: %s", err)
+	}
+	if _, err := os.Stat(series); !os.IsNotExist(err) {
+		t.Errorf("Expected created folders to be removed, got %v", err)
+	}
+	entries, _ = readJournal(journalFile)
+	if runs := journalRuns(entries); !runs[0].Undone {
+		t.Error("Expected run to be marked as undone")
+	}
+
+	// Targets that changed since the run must not be touched.
+	e = NewApp(true, "copy", series, series, "force", false, "0", false, false)
+	e.journal = newJournal(journalFile + ".2")
+	e.executeOperations(e.collectFileOperations(source))
+	if err := ioutil.WriteFile(target, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = readJournal(journalFile + ".2")
+	if err := undoRun(journalRuns(entries)[0], e.journal, false); err == nil {
+		t.Error("Expected undo to refuse a changed target")
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("Expected changed target to be kept: %s", err)
+	}
+
+	// An undo that partially failed can be finished once the target is back as it was.
+	createFile(filepath.Join(tmpdir, "Angel.S04E03.mkv"))
+	e.journal = newJournal(journalFile + ".3")
+	os.Remove(target)
+	ops = e.collectFileOperations(source)
+	ops = append(ops, e.collectFileOperations(filepath.Join(tmpdir, "Angel.S04E03.mkv"))...)
+	e.executeOperations(ops)
+	entries, _ = readJournal(journalFile + ".3")
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 journal entries, got %+v", entries)
+	}
+	ioutil.WriteFile(target, []byte("changed"), 0644)
+	if err := undoRun(journalRuns(entries)[0], e.journal, false); err == nil {
+		t.Error("Expected undo to refuse a changed target")
+	}
+	ioutil.WriteFile(target, nil, 0644)
+	os.Chtimes(target, entries[0].ModTime, entries[0].ModTime)
+	entries, _ = readJournal(journalFile + ".3")
+	if run := journalRuns(entries)[0]; len(run.Operations) != 1 || undoRun(run, e.journal, false) != nil {
+		t.Errorf("Expected only the failed operation to be undone again, got %+v", run.Operations)
+	}
+	entries, _ = readJournal(journalFile + ".3")
+	if runs := journalRuns(entries); !runs[0].Undone {
+		t.Error("Expected run to be marked as undone")
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	name := "Angel.S04E02.mkv"
+	tests := map[string]struct {
+		existing string
+		result   string
+		content  string
+	}{
+		"skip":        {"old", resultSkipped, "old"},
+		"overwrite":   {"old", resultOverwritten, "source"},
+		"suffix":      {"old", resultSuffixed, "old"},
+		"keep-larger": {"older content", resultSkipped, "older content"},
+		"keep-newer":  {"old", resultOverwritten, "source"},
+		"fail":        {"old", resultFailed, "old"},
+	}
+
+	for policy, tt := range tests {
+		tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpdir)
+		target := filepath.Join(tmpdir, "series", "Angel", "Season 04", "Angel - S04E02.mkv")
+		os.MkdirAll(filepath.Dir(target), 0755)
+		ioutil.WriteFile(target, []byte(tt.existing), 0644)
+		// Make sure the source is newer than the existing target.
+		os.Chtimes(target, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+		ioutil.WriteFile(filepath.Join(tmpdir, name), []byte("source"), 0644)
+
+		e := NewApp(true, "copy", filepath.Join(tmpdir, "series"), filepath.Join(tmpdir, "series"), "force", false, "0", false, false)
+		e.onConflict = policy
+		e.trash = filepath.Join(tmpdir, "trash")
+		ops := e.collectFileOperations(filepath.Join(tmpdir, name))
+		if len(ops) != 1 || !ops[0].Conflict {
+			t.Fatalf("%s: expected the plan to contain a conflict, got %+v", policy, ops)
+		}
+		e.executeOperations(ops)
+
+		if ops[0].Result != tt.result {
+			t.Errorf("%s: expected result '%s', got '%s'", policy, tt.result, ops[0].Result)
+		}
+		if content, _ := ioutil.ReadFile(target); string(content) != tt.content {
+			t.Errorf("%s: expected target to contain '%s', got '%s'", policy, tt.content, content)
+		}
+		if tt.result == resultOverwritten {
+			if matches, _ := filepath.Glob(filepath.Join(e.trash, "*", "Angel - S04E02.mkv")); len(matches) != 1 {
+				t.Errorf("%s: expected the old target in the trash folder, got %v", policy, matches)
+			}
+		}
+		if policy == "suffix" {
+			if content, _ := ioutil.ReadFile(filepath.Join(filepath.Dir(target), "Angel - S04E02 (1).mkv")); string(content) != "source" {
+				t.Errorf("suffix: expected the copy next to the existing target, got '%s'", content)
+			}
+		}
+	}
+}
+
+func TestQualityUpgrades(t *testing.T) {
+	ranking := identify.DefaultQualityRanking
+	better := identify.NewParsedFile("The.Matrix.1999.2160p.WEB-DL.x265.mkv")
+	worse := identify.NewParsedFile("The Matrix (1999) 720p.BluRay.x264.mkv")
+	proper := identify.NewParsedFile("The.Matrix.1999.720p.BluRay.PROPER.x264.mkv")
+	if !identify.SameIdentity(better, worse) {
+		t.Error("Expected both releases to be the same movie")
+	}
+	if ranking.Compare(better, worse) <= 0 || ranking.Compare(worse, better) >= 0 {
+		t.Error("Expected 2160p to rank above 720p")
+	}
+	if ranking.Compare(proper, worse) <= 0 {
+		t.Error("Expected a PROPER release to rank above the original")
+	}
+	sourceFirst := identify.QualityRanking{Resolutions: []string{}, Sources: []string{"BluRay", "WEB-DL"}}
+	if sourceFirst.Compare(worse, better) <= 0 {
+		t.Error("Expected a ranking without resolutions to prefer the BluRay")
+	}
+
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	movies := filepath.Join(tmpdir, "movies")
+	trash := filepath.Join(tmpdir, "trash")
+	existing := filepath.Join(movies, "The Matrix (1999)", "The Matrix (1999) 720p.mkv")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	createFile(existing)
+	createFile(filepath.Join(tmpdir, "The.Matrix.1999.2160p.WEB-DL.x265.mkv"))
+	createFile(filepath.Join(tmpdir, "The.Matrix.1999.480p.DVDRip.XviD.mkv"))
+
+	e := NewApp(false, "copy", movies, movies, "force", false, "0", false, false)
+	e.upgrade = true
+	e.trash = trash
+	ops, err := e.collectPlannedOperations(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Operations are sorted by path, so the 2160p release comes first.
+	if len(ops) != 2 || len(ops[0].Replaces) != 1 || !ops[1].Inferior {
+		t.Fatalf("Expected the DVDRip to be inferior and the 2160p release to replace the 720p one, got %+v", ops)
+	}
+	e.executeOperations(ops)
+
+	if ops[0].Result != resultUpgraded || ops[1].Result != resultSkipped {
+		t.Errorf("Unexpected results '%s' and '%s'", ops[0].Result, ops[1].Result)
+	}
+	if _, err := os.Stat(existing); !os.IsNotExist(err) {
+		t.Error("Expected the 720p release to be moved away")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(trash, "*", "The Matrix (1999) 720p.mkv")); len(matches) != 1 {
+		t.Errorf("Expected the 720p release in the trash folder, got %v", matches)
+	}
+	if _, err := os.Stat(filepath.Join(movies, "The Matrix (1999)", "The Matrix (1999) 2160p.mkv")); err != nil {
+		t.Errorf("Expected the 2160p release in the library: %s", err)
+	}
+}
+
+func TestUpgradeSameRelease(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	movies := filepath.Join(tmpdir, "movies")
+	existing := filepath.Join(movies, "The Matrix (1999)", "The Matrix (1999) 720p.mkv")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	createFile(existing)
+	createFile(filepath.Join(tmpdir, "The.Matrix.1999.720p.BluRay.PROPER.x264.mkv"))
+
+	// The library file lost its source, codec and PROPER tag when it was renamed.
+	e := NewApp(false, "copy", movies, movies, "force", false, "0", false, false)
+	e.upgrade = true
+	e.trash = filepath.Join(tmpdir, "trash")
+	ops, err := e.collectPlannedOperations(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || !ops[0].Inferior || len(ops[0].Replaces) != 0 {
+		t.Fatalf("Expected the same release not to replace the library file, got %+v", ops)
+	}
+}
+
+func TestUpgradeWithoutQualityInNames(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	movies, source := filepath.Join(tmpdir, "movies"), filepath.Join(tmpdir, "source")
+	existing := filepath.Join(movies, "The Matrix (1999)", "The Matrix (1999).mkv")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	os.Mkdir(source, 0755)
+	ioutil.WriteFile(existing, []byte("720p release"), 0644)
+
+	e := NewApp(false, "copy", movies, movies, "force", false, "0", false, false)
+	e.movieFormat = "{n} ({y})/{n} ({y})"
+	e.upgrade = true
+	e.trash = filepath.Join(tmpdir, "trash")
+
+	// Nothing tells the quality of the library file, so the size decides.
+	ioutil.WriteFile(filepath.Join(source, "The.Matrix.1999.480p.DVDRip.mkv"), []byte("small"), 0644)
+	ops, err := e.collectPlannedOperations(source)
+	if err != nil || len(ops) != 1 || !ops[0].Inferior {
+		t.Fatalf("Expected a smaller release to be inferior, got %+v (%v)", ops, err)
+	}
+
+	os.Remove(filepath.Join(source, "The.Matrix.1999.480p.DVDRip.mkv"))
+	ioutil.WriteFile(filepath.Join(source, "The.Matrix.1999.2160p.WEB-DL.mkv"), []byte("the much larger 2160p release"), 0644)
+	ops, err = e.collectPlannedOperations(source)
+	if err != nil || len(ops) != 1 || len(ops[0].Replaces) != 1 {
+		t.Fatalf("Expected a larger release to replace the library file, got %+v (%v)", ops, err)
+	}
+	e.executeOperations(ops)
+	if content, _ := ioutil.ReadFile(existing); ops[0].Result != resultUpgraded || string(content) != "the much larger 2160p release" {
+		t.Errorf("Expected the library file to be upgraded, got %s with '%s'", ops[0].Result, content)
+	}
+}
+
+func TestPlaceReplacedTarget(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	source := filepath.Join(tmpdir, "new.mkv")
+	target := filepath.Join(tmpdir, "library", "The Matrix (1999).mkv")
+	os.MkdirAll(filepath.Dir(target), 0755)
+	ioutil.WriteFile(target, []byte("old"), 0644)
+
+	e := NewApp(false, "move", tmpdir, tmpdir, "force", false, "0", false, false)
+	e.trash = filepath.Join(tmpdir, "trash")
+	// A failing transfer leaves the replaced target alone.
+	if err := e.place(source, target, []string{target}); err == nil {
+		t.Fatal("Expected the transfer of a missing source to fail")
+	}
+	if content, _ := ioutil.ReadFile(target); string(content) != "old" {
+		t.Errorf("Expected the old target to be kept, got '%s'", content)
+	}
+
+	ioutil.WriteFile(source, []byte("new"), 0644)
+	if err := e.place(source, target, []string{target}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(target); string(content) != "new" {
+		t.Errorf("Expected the new file at the target, got '%s'", content)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(e.trash, "*", "The Matrix (1999).mkv")); len(matches) != 1 {
+		t.Errorf("Expected the old target in the trash folder, got %v", matches)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(target), "*"+stagedSuffix)); len(leftovers) != 0 {
+		t.Errorf("Expected no staged files, got %v", leftovers)
+	}
+}
+
+func TestMoveAcrossFilesystems(t *testing.T) {
+	name := "Angel.S04E02.mkv"
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	source := filepath.Join(tmpdir, name)
+	if err := ioutil.WriteFile(source, []byte("episode content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(source, mtime, mtime)
+
+	renameFile = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	defer func() { renameFile = os.Rename }()
+
+	f := identify.NewParsedFile(source, identify.Options{Mode: "force"})
+	if err := performIn(f, tmpdir, "move"); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(tmpdir, "Angel", "Season 04", "Angel - S04E02.mkv")
+	content, err := ioutil.ReadFile(target)
+	if err != nil || string(content) != "episode content" {
+		t.Fatalf("Expected the copied content at the target, got '%s' (%v)", content, err)
+	}
+	if info, _ := os.Stat(target); !info.ModTime().Equal(mtime) || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected modification time and mode to be preserved, got %s and %s", info.ModTime(), info.Mode())
+	}
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Error("Expected the source to be removed after the copy")
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(target), "*"+partialSuffix)); len(leftovers) != 0 {
+		t.Errorf("Expected no temporary files, got %v", leftovers)
+	}
+}
+
+func TestResumeCopy(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	content := bytes.Repeat([]byte("0123456789"), 300000)
+	source := filepath.Join(tmpdir, "source.mkv")
+	target := filepath.Join(tmpdir, "target.mkv")
+	if err := ioutil.WriteFile(source, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A valid prefix is resumed, the rest is appended.
+	if err := ioutil.WriteFile(target+partialSuffix, content[:1500000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(source, target, true); err != nil {
+		t.Fatal(err)
+	}
+	if copied, _ := ioutil.ReadFile(target); !bytes.Equal(copied, content) {
+		t.Errorf("Expected the resumed copy to match the source, got %d bytes", len(copied))
+	}
+	if _, err := os.Stat(target + partialSuffix); !os.IsNotExist(err) {
+		t.Error("Expected the partial file to be renamed into place")
+	}
+
+	// A partial file with different content is started over.
+	os.Remove(target)
+	if err := ioutil.WriteFile(target+partialSuffix, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(source, target, false); err != nil {
+		t.Fatal(err)
+	}
+	if copied, _ := ioutil.ReadFile(target); !bytes.Equal(copied, content) {
+		t.Errorf("Expected a mismatching partial file to be replaced, got %d bytes", len(copied))
+	}
+}
+
+func TestReflinkFallback(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	source := filepath.Join(tmpdir, "source.mkv")
+	if err := ioutil.WriteFile(source, []byte("movie content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sourceInfo, _ := os.Stat(source)
+	supported := reflink(source, filepath.Join(tmpdir, "probe.mkv")) == nil
+
+	for _, fallback := range []string{"copy", "hardlink", "none"} {
+		target := filepath.Join(tmpdir, fallback+".mkv")
+		err := transfer(source, target, "reflink", transferOptions{reflinkFallback: fallback})
+		if !supported && fallback == "none" {
+			if err == nil || !reflinkUnsupported(err) {
+				t.Errorf("Expected an unsupported error without fallback, got %v", err)
+			}
+			if _, err := os.Stat(target); !os.IsNotExist(err) {
+				t.Error("Expected no target to be left behind by a failed reflink")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("reflink with fallback %s: %s", fallback, err)
+		}
+		if content, _ := ioutil.ReadFile(target); string(content) != "movie content" {
+			t.Errorf("Expected the content of the source with fallback %s, got '%s'", fallback, content)
+		}
+		info, _ := os.Stat(target)
+		if linked := os.SameFile(sourceInfo, info); linked != (!supported && fallback == "hardlink") {
+			t.Errorf("Unexpected result with fallback %s, hardlinked: %v, reflinks supported: %v", fallback, linked, supported)
+		}
+	}
+}
+
+func TestPlanCollisions(t *testing.T) {
+	files := map[string]string{
+		"Angel.S04E02.720p.HDTV.x264.mkv":    "larger but worse",
+		"Angel.S04E02.1080p.BluRay.x264.mkv": "better",
+		"Angel.S04E03.1080p.WEB-DL.H264.mkv": "other episode",
+	}
+	tests := map[string]string{
+		"largest": "Angel.S04E02.720p.HDTV.x264.mkv",
+		"quality": "Angel.S04E02.1080p.BluRay.x264.mkv",
+		"first":   "Angel.S04E02.1080p.BluRay.x264.mkv",
+	}
+
+	for policy, kept := range tests {
+		tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpdir)
+		source := filepath.Join(tmpdir, "source")
+		os.Mkdir(source, 0755)
+		for name, content := range files {
+			ioutil.WriteFile(filepath.Join(source, name), []byte(content), 0644)
+		}
+
+		e := NewApp(true, "copy", tmpdir, tmpdir, "force", false, "0", false, false)
+		e.seriesFormat = "{n}/Season {s}/{n} - S{s}E{e}"
+		e.onCollision = policy
+		ops, err := e.collectPlannedOperations(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ops) != 3 {
+			t.Fatalf("%s: expected 3 operations, got %d", policy, len(ops))
+		}
+		for _, op := range ops {
+			name := filepath.Base(op.SourcePath)
+			if strings.Contains(name, "S04E03") {
+				if op.Skip || len(op.CollidesWith) != 0 {
+					t.Errorf("%s: expected %s not to collide", policy, name)
+				}
+				continue
+			}
+			if len(op.CollidesWith) != 1 {
+				t.Errorf("%s: expected %s to collide with one other file, got %v", policy, name, op.CollidesWith)
+			}
+			if op.Skip != (name != kept) {
+				t.Errorf("%s: expected only %s to be kept, %s has skip %v", policy, kept, name, op.Skip)
+			}
+		}
+
+		e.executeOperations(ops)
+		content, _ := ioutil.ReadFile(filepath.Join(tmpdir, "Angel", "Season 04", "Angel - S04E02.mkv"))
+		if string(content) != files[kept] {
+			t.Errorf("%s: expected the content of %s at the target, got '%s'", policy, kept, content)
+		}
+		if summary := summarizeResults(ops); summary != "2 done, 1 skipped" {
+			t.Errorf("%s: unexpected results %s", policy, summary)
+		}
+	}
+}
+
+func TestCaseInsensitiveCollisions(t *testing.T) {
+	e := NewApp(true, "copy", "series", "series", "force", false, "0", false, false)
+	plan := func() []PlannedOperation {
+		return []PlannedOperation{
+			{SourcePath: "a.mkv", TargetPath: filepath.Join("series", "Angel", "Angel - S04E02.mkv")},
+			{SourcePath: "b.mkv", TargetPath: filepath.Join("series", "angel", "angel - s04e02.mkv")},
+		}
+	}
+
+	ops := plan()
+	e.resolveCollisions(ops)
+	if ops[0].Skip || ops[1].Skip {
+		t.Error("Expected targets that differ in case not to collide on posix")
+	}
+	e.sanitize = "smb"
+	ops = plan()
+	e.resolveCollisions(ops)
+	if len(ops[0].CollidesWith) != 1 || ops[0].Skip == ops[1].Skip {
+		t.Errorf("Expected targets that differ in case to collide on smb, got %+v", ops)
+	}
+}
+
+func TestCleanupSources(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	root := filepath.Join(tmpdir, "downloads")
+	files := []string{
+		"Apollo.11.2019.1080p.BluRay/Apollo.11.2019.1080p.BluRay.mkv",
+		"Apollo.11.2019.1080p.BluRay/apollo.11.NFO",
+		"Apollo.11.2019.1080p.BluRay/Sample/apollo.11.sample.mkv",
+		"Angel.S04.720p/Angel.S04E02.720p.mkv",
+		"Angel.S04.720p/angel.nfo",
+		"Angel.S04.720p/notes.doc",
+		"Angel.S04E03.mkv",
+	}
+	for _, f := range files {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(f)), 0755)
+		ioutil.WriteFile(filepath.Join(root, f), []byte(f), 0644)
+	}
+	os.Mkdir(filepath.Join(root, "Apollo.11.2019.1080p.BluRay", "Subs"), 0755)
+
+	for _, mode := range []string{"dry-run", "force"} {
+		e := NewApp(true, "move", filepath.Join(tmpdir, "movies"), filepath.Join(tmpdir, "series"), mode, false, "0", false, false)
+		e.cleanup = true
+		e.StartRun(root)
+
+		_, err := os.Stat(filepath.Join(root, "Apollo.11.2019.1080p.BluRay"))
+		if mode == "dry-run" && err != nil {
+			t.Errorf("Expected nothing to be removed in a dry-run, got %v", err)
+		}
+		if mode == "force" && !os.IsNotExist(err) {
+			t.Errorf("Expected the folder with only leftovers to be removed, got %v", err)
+		}
+	}
+
+	for _, kept := range []string{"Angel.S04.720p/angel.nfo", "Angel.S04.720p/notes.doc"} {
+		if _, err := os.Stat(filepath.Join(root, kept)); err != nil {
+			t.Errorf("Expected %s to be kept next to a file that is not on the junk list: %v", kept, err)
+		}
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("Expected the scanned folder itself to be kept: %v", err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var requests []map[string]interface{}
+	var mu sync.Mutex
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		requests = append(requests, payload)
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	run := func(mode string, hooks []Hook) (string, []PlannedOperation) {
+		tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := filepath.Join(tmpdir, "source")
+		os.Mkdir(source, 0755)
+		for _, name := range []string{"Angel.S04E02.mkv", "Angel.S04E03.mkv"} {
+			ioutil.WriteFile(filepath.Join(source, name), []byte(name), 0644)
+		}
+		for i := range hooks {
+			if err := hooks[i].validate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		requests = nil
+		e := NewApp(true, "copy", tmpdir, tmpdir, mode, false, "0", false, false)
+		e.hooks = hooks
+		ops, err := e.collectPlannedOperations(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.finishRun(source, ops)
+		return tmpdir, ops
+	}
+
+	output := filepath.Join(os.TempDir(), fmt.Sprintf("hooks-%d", time.Now().UnixNano()))
+	defer os.Remove(output)
+	tmpdir, _ := run("force", []Hook{
+		{Event: hookOperation, URL: ts.URL},
+		{Event: hookOperation, Command: []string{"sh", "-c", `echo "$OLARIS_TARGET" >> ` + output}},
+		{Event: hookRun, URL: ts.URL},
+	})
+	defer os.RemoveAll(tmpdir)
+	if len(requests) != 3 || requests[0]["event"] != hookOperation || requests[2]["event"] != hookRun {
+		t.Fatalf("Expected two operation and one run webhook, got %v", requests)
+	}
+	if file, ok := requests[0]["file"].(map[string]interface{}); !ok || file["name"] != "Angel" || file["episode"] != "02" {
+		t.Errorf("Expected the identified file in the payload, got %v", requests[0]["file"])
+	}
+	if results := requests[2]["results"].(map[string]interface{}); results[resultDone] != 2.0 {
+		t.Errorf("Expected the results of the run in the payload, got %v", results)
+	}
+	targets, _ := ioutil.ReadFile(output)
+	if !strings.Contains(string(targets), filepath.Join(tmpdir, "Angel", "Season 04", "Angel - S04E03.mkv")) {
+		t.Errorf("Expected the command to get the target in its environment, got '%s'", targets)
+	}
+
+	tmpdir, _ = run("dry-run", []Hook{{Event: hookOperation, URL: ts.URL}})
+	defer os.RemoveAll(tmpdir)
+	if len(requests) != 0 {
+		t.Errorf("Expected no hooks to run in a dry-run, got %v", requests)
+	}
+
+	fail = true
+	tmpdir, ops := run("force", []Hook{{Event: hookOperation, URL: ts.URL, OnFailure: "abort"}})
+	defer os.RemoveAll(tmpdir)
+	if len(requests) != 1 || ops[0].Result != resultDone || ops[1].Result != resultSkipped {
+		t.Errorf("Expected a failing hook to abort the run, got %d requests and %s", len(requests), summarizeResults(ops))
+	}
+}
+
+func TestMediaServerRefresh(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	movies, series := filepath.Join(tmpdir, "movies"), filepath.Join(tmpdir, "series")
+	source := filepath.Join(tmpdir, "source")
+	os.Mkdir(source, 0755)
+	for _, name := range []string{"Angel.S04E02.mkv", "Angel.S04E03.mkv", "Apollo.11.2019.mkv"} {
+		ioutil.WriteFile(filepath.Join(source, name), []byte(name), 0644)
+	}
+
+	var mu sync.Mutex
+	var requests []string
+	var bodies []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		token := r.Header.Get("X-Plex-Token") + r.Header.Get("X-Emby-Token") + r.Header.Get("Authorization")
+		requests = append(requests, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, token))
+		if r.URL.Path == "/library/sections" {
+			fmt.Fprintf(w, `{"MediaContainer": {"Directory": [{"key": "1", "Location": [{"path": %q}]}, {"key": "2", "Location": [{"path": %q}]}]}}`, movies, series)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/refresh") {
+			requests = append(requests, "path "+r.URL.Query().Get("path"))
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+	}))
+	defer ts.Close()
+
+	servers := []MediaServer{
+		{Type: "plex", URL: ts.URL, Token: "plex-token"},
+		{Type: "jellyfin", URL: ts.URL + "/", Token: "jellyfin-token"},
+		{Type: "olaris", URL: ts.URL, Token: "olaris-token"},
+	}
+	for i := range servers {
+		if err := servers[i].validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, mode := range []string{"dry-run", "force"} {
+		requests = nil
+		e := NewApp(true, "copy", movies, series, mode, false, "0", false, false)
+		e.mediaServers = servers
+		e.StartRun(source)
+		if mode == "dry-run" && len(requests) != 0 {
+			t.Errorf("Expected no requests in a dry-run, got %v", requests)
+		}
+	}
+
+	season := filepath.Join(series, "Angel", "Season 04")
+	movie := filepath.Join(movies, "Apollo 11 (2019)")
+	expected := []string{
+		"GET /library/sections plex-token",
+		"GET /library/sections/1/refresh plex-token",
+		"path " + movie,
+		"GET /library/sections/2/refresh plex-token",
+		"path " + season,
+		"POST /Library/Media/Updated jellyfin-token",
+		"POST /olaris/m/query Bearer olaris-token",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected requests:\n%s", strings.Join(requests, "\n"))
+	}
+	if updates := bodies[2]["Updates"].([]interface{}); len(updates) != 2 {
+		t.Errorf("Expected both folders in a single Jellyfin request, got %v", updates)
+	}
+	if variables := bodies[3]["variables"].(map[string]interface{}); len(variables) != 2 || !strings.Contains(bodies[3]["query"].(string), "rescanLibraries") {
+		t.Errorf("Expected both folders in a single olaris-server request, got %v", bodies[3])
+	}
+}
+
+func TestReviewOperations(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	movies, series := filepath.Join(tmpdir, "movies"), filepath.Join(tmpdir, "series")
+	source := filepath.Join(tmpdir, "source")
+	os.Mkdir(source, 0755)
+	for _, name := range []string{"Angel.S04E02.mkv", "Angel.S04E03.mkv", "Apollo.11.2019.mkv", "Apollo.13.1995.mkv"} {
+		ioutil.WriteFile(filepath.Join(source, name), []byte(name), 0644)
+	}
+
+	e := NewApp(true, "copy", movies, series, "interactive", false, "0", false, false)
+	plan := func() []PlannedOperation {
+		ops, err := e.collectPlannedOperations(source)
+		if err != nil || len(ops) != 4 {
+			t.Fatalf("Expected 4 operations, got %d (%v)", len(ops), err)
+		}
+		return ops
+	}
+
+	// Skip the first file, edit the target of the second and identify the third again.
+	ops := plan()
+	input := "n\ne\nAngel/Angel - Soulless.mkv\ny\nr\nThe Martian\n2015\ny\n\n"
+	if !e.reviewOperations(bufio.NewReader(strings.NewReader(input)), ops) {
+		t.Fatal("Expected the review to be accepted")
+	}
+	e.executeOperations(ops)
+	expected := []string{
+		resultSkipped, filepath.Join(series, "Angel", "Season 04", "Angel - S04E02.mkv"),
+		resultDone, filepath.Join(series, "Angel", "Angel - Soulless.mkv"),
+		resultDone, filepath.Join(movies, "The Martian (2015)", "The Martian (2015).mkv"),
+		resultDone, filepath.Join(movies, "Apollo 13 (1995)", "Apollo 13 (1995).mkv"),
+	}
+	for i, op := range ops {
+		if op.Result != expected[i*2] || op.TargetPath != expected[i*2+1] {
+			t.Errorf("Expected operation %d to be %s at %s, got %s at %s", i+1, expected[i*2], expected[i*2+1], op.Result, op.TargetPath)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(series, "Angel", "Season 04", "Angel - S04E02.mkv")); !os.IsNotExist(err) {
+		t.Error("Expected the skipped file not to be copied")
+	}
+
+	// Accept all remaining files after skipping the first one, or quit.
+	ops = plan()
+	if !e.reviewOperations(bufio.NewReader(strings.NewReader("n\na\n")), ops) || !ops[0].Skip || ops[1].Skip || ops[3].Skip {
+		t.Error("Expected all files after the first one to be accepted")
+	}
+	if e.reviewOperations(bufio.NewReader(strings.NewReader("y\nq\n")), plan()) {
+		t.Error("Expected quitting to cancel the run")
+	}
+}
+
+func TestReviewCollisions(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	source := filepath.Join(tmpdir, "source")
+	os.Mkdir(source, 0755)
+	ioutil.WriteFile(filepath.Join(source, "Angel.S04E02.1080p.BluRay.x264.mkv"), []byte("smaller"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "Angel.S04E02.720p.HDTV.x264.mkv"), []byte("the larger one"), 0644)
+
+	e := NewApp(true, "copy", tmpdir, tmpdir, "interactive", false, "0", false, false)
+	e.seriesFormat = "{n}/Season {s}/{n} - S{s}E{e}"
+	review := func(input string) []PlannedOperation {
+		ops, err := e.collectPlannedOperations(source)
+		if err != nil || len(ops) != 2 || !ops[0].Skip || ops[1].Skip {
+			t.Fatalf("Expected the smaller file to lose the collision, got %+v (%v)", ops, err)
+		}
+		if !e.reviewOperations(bufio.NewReader(strings.NewReader(input)), ops) {
+			t.Fatal("Expected the review to be accepted")
+		}
+		return ops
+	}
+
+	if ops := review("a\n"); !ops[0].Skip || ops[1].Skip {
+		t.Error("Expected accepting all files to keep the collision loser skipped")
+	}
+	if ops := review("y\n\n"); ops[0].Skip || !ops[1].Skip {
+		t.Error("Expected picking the loser to skip the other file")
+	}
+	ops := review("\ne\nAngel/Angel - Other.mkv\n\n")
+	if ops[0].Skip || ops[1].Skip || len(ops[0].CollidesWith) != 0 || len(ops[1].CollidesWith) != 0 {
+		t.Errorf("Expected both files to be selected once they no longer collide, got %+v", ops)
+	}
+}
+
+func TestPlanView(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	movies, series := filepath.Join(tmpdir, "movies"), filepath.Join(tmpdir, "series")
+	source := filepath.Join(tmpdir, "source")
+	os.Mkdir(source, 0755)
+	for _, name := range []string{"Angel.S04E02.mkv", "Angel.S04E03.mkv", "Apollo.11.2019.mkv"} {
+		ioutil.WriteFile(filepath.Join(source, name), []byte(name), 0644)
+	}
+	e := NewApp(true, "copy", movies, series, "tui", false, "0", false, false)
+	ops, err := e.collectPlannedOperations(source)
+	if err != nil || len(ops) != 3 {
+		t.Fatalf("Expected 3 operations, got %d (%v)", len(ops), err)
+	}
+
+	in := bufio.NewReader(strings.NewReader("\x1b[A\x1b[6~j\r"))
+	for _, expected := range []string{"up", "pgdn", "j", "enter"} {
+		k, err := readKey(in)
+		if err != nil || (k.name != expected && string(k.r) != expected) {
+			t.Errorf("Expected key %s, got %+v (%v)", expected, k, err)
+		}
+	}
+
+	v := newPlanView(e, ops)
+	press := func(keys ...key) (bool, bool) {
+		var done, apply bool
+		for _, k := range keys {
+			done, apply = v.handleKey(k)
+		}
+		return done, apply
+	}
+	text := func(s string) []key {
+		var keys []key
+		for _, r := range s {
+			keys = append(keys, key{r: r})
+		}
+		return keys
+	}
+
+	// The cursor starts on the header of the season, space deselects the whole group.
+	press(key{r: ' '})
+	if !ops[0].Skip || !ops[1].Skip || ops[2].Skip {
+		t.Errorf("Expected the season to be deselected, got %v %v %v", ops[0].Skip, ops[1].Skip, ops[2].Skip)
+	}
+	press(key{r: ' '})
+
+	// Deselect everything matching a filter.
+	press(text("/apollo")...)
+	if len(v.rows) != 2 || v.rows[0].group != "Movies" {
+		t.Errorf("Expected only the movie to match the filter, got %v", v.rows)
+	}
+	press(key{name: "enter"}, key{r: 'n'}, key{r: '/'}, key{name: "esc"})
+	if len(v.rows) != 5 || !ops[2].Skip || ops[1].Skip {
+		t.Errorf("Expected only the movie to be deselected and the filter to be cleared, got %d rows", len(v.rows))
+	}
+
+	// Edit the target of the first episode.
+	press(key{name: "home"}, key{name: "down"}, key{r: 'e'})
+	for range ops[0].TargetPath {
+		press(key{name: "backspace"})
+	}
+	press(append(text(filepath.Join(series, "Angel", "Pilot.mkv")), key{name: "enter"})...)
+	if ops[0].TargetPath != filepath.Join(series, "Angel", "Pilot.mkv") {
+		t.Errorf("Expected the target to be edited, got %s", ops[0].TargetPath)
+	}
+
+	screen := strings.Join(v.render(120, 20), "\n")
+	for _, expected := range []string{"3 file(s), 2 selected", "[x] Angel / Season 04 (2/2)", "edited", "-> Angel/Pilot.mkv", "[ ] Movies (0/1)"} {
+		if !strings.Contains(screen, expected) {
+			t.Errorf("Expected the screen to contain '%s':\n%s", expected, screen)
+		}
+	}
+
+	if done, apply := press(key{name: "enter"}, key{r: 'y'}); !done || !apply {
+		t.Fatal("Expected the plan to be applied")
+	}
+	e.executeOperations(ops)
+	if _, err := os.Stat(filepath.Join(series, "Angel", "Pilot.mkv")); err != nil {
+		t.Errorf("Expected the edited target to be used: %v", err)
+	}
+	if ops[2].Result != resultSkipped {
+		t.Errorf("Expected the deselected movie to be skipped, got %s", ops[2].Result)
+	}
+}
+
+func TestPlanViewCollisions(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	source := filepath.Join(tmpdir, "source")
+	os.Mkdir(source, 0755)
+	ioutil.WriteFile(filepath.Join(source, "Angel.S04E02.1080p.BluRay.x264.mkv"), []byte("smaller"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "Angel.S04E02.720p.HDTV.x264.mkv"), []byte("the larger one"), 0644)
+
+	e := NewApp(true, "copy", tmpdir, tmpdir, "tui", false, "0", false, false)
+	e.seriesFormat = "{n}/Season {s}/{n} - S{s}E{e}"
+	ops, err := e.collectPlannedOperations(source)
+	if err != nil || len(ops) != 2 || !ops[0].Skip || ops[1].Skip {
+		t.Fatalf("Expected the smaller file to lose the collision, got %+v (%v)", ops, err)
+	}
+
+	// Selecting everything or the whole group leaves the loser skipped.
+	v := newPlanView(e, ops)
+	v.handleKey(key{r: 'a'})
+	v.handleKey(key{r: ' '})
+	v.handleKey(key{r: ' '})
+	if !ops[0].Skip || ops[1].Skip {
+		t.Errorf("Expected the collision loser to stay skipped, got %v %v", ops[0].Skip, ops[1].Skip)
+	}
+	// Picking the loser skips the other file.
+	v.handleKey(key{name: "down"})
+	v.handleKey(key{r: ' '})
+	if ops[0].Skip || !ops[1].Skip {
+		t.Errorf("Expected picking the loser to skip the other file, got %v %v", ops[0].Skip, ops[1].Skip)
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "bis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	series := filepath.Join(tmpdir, "series")
+	source := filepath.Join(tmpdir, "source")
+	os.Mkdir(source, 0755)
+	names := []string{"Angel.S04E02.mkv", "Angel.S04E03.mkv", "Angel.S04E04.mkv", "Angel.S04E05.mkv"}
+	for _, name := range names {
+		ioutil.WriteFile(filepath.Join(source, name), []byte(name), 0644)
+	}
+
+	planPath := filepath.Join(tmpdir, "plan.json")
+	e := NewApp(true, "move", series, series, "dry-run", false, "0", false, false)
+	e.planOut = planPath
+	e.StartRun(source)
+	if _, err := os.Stat(filepath.Join(source, names[0])); err != nil {
+		t.Fatal("Expected the dry-run not to touch any files")
+	}
+
+	plan, err := readPlan(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Operations) != 4 || plan.Operations[0].File.CleanName != "Angel" || plan.Operations[0].SourceState == nil {
+		t.Fatalf("Expected the plan to contain the identified files, got %+v", plan.Operations)
+	}
+
+	// Edit a target like a human would, change one source and remove another.
+	edited := filepath.Join(series, "Angel", "Angel - Orpheus.mkv")
+	plan.Operations[1].TargetPath = edited
+	ioutil.WriteFile(filepath.Join(source, names[2]), []byte("a changed file"), 0644)
+	os.Remove(filepath.Join(source, names[3]))
+	data, _ := json.Marshal(plan)
+	ioutil.WriteFile(planPath, data, 0644)
+	if plan, err = readPlan(planPath); err != nil {
+		t.Fatal(err)
+	}
+
+	e = NewApp(false, plan.Action, series, series, "force", false, "0", false, false)
+	ops, refused := e.applyPlan(plan)
+	if refused != 2 || len(ops) != 2 {
+		t.Fatalf("Expected 2 operations to be applied and 2 to be refused, got %d and %d", len(ops), refused)
+	}
+	for _, target := range []string{filepath.Join(series, "Angel", "Season 04", "Angel - S04E02.mkv"), edited} {
+		if _, err := os.Stat(target); err != nil {
+			t.Errorf("Expected the plan to be applied: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(source, names[2])); err != nil {
+		t.Errorf("Expected the changed source to be left alone: %v", err)
+	}
+}
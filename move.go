@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// renameFile is os.Rename, tests replace it to simulate moves between filesystems.
+var renameFile = os.Rename
+
+// copyProgressInterval is how often the progress of a copy is logged.
+var copyProgressInterval = 10 * time.Second
+
+// partialSuffix is added to the name of files that are still being copied.
+const partialSuffix = ".partial"
+
+// stagedSuffix is added to the name of files that wait for the file they replace to be moved
+// out of the way.
+const stagedSuffix = ".staged"
+
+// copyBufferSize is the size of the chunks used for copying and comparing files.
+const copyBufferSize = 1024 * 1024
+
+// moveFile moves source to target. When they are on different filesystems the file is copied
+// and verified instead, the source is only removed after the copy is complete.
+func moveFile(source, target string) error {
+	err := renameFile(source, target)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	log.WithFields(log.Fields{"source": source, "target": target}).Infoln("Source and target are on different filesystems, copying the file instead.")
+	if err := copyFile(source, target, true); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+// copyFile copies source to target through a .partial file next to the target, which is
+// renamed into place when the copy is complete so target is never half written. A partial file
+// left behind by an earlier attempt is resumed when it is a prefix of the source. With verify
+// set the checksums of source and copy are compared before the rename. Modification time and
+// mode of the source are preserved.
+func copyFile(source, target string, verify bool) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	partial := target + partialSuffix
+	out, offset, err := openPartial(partial, in, info.Size())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if offset > 0 {
+		log.WithFields(log.Fields{"target": target, "offset": offset, "size": info.Size()}).Infoln("Resuming earlier copy")
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	progress := &copyProgress{target: target, total: info.Size(), copied: offset, last: time.Now()}
+	if _, err := io.CopyBuffer(io.MultiWriter(out, progress), in, make([]byte, copyBufferSize)); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if verify {
+		if err := verifyCopy(source, partial); err != nil {
+			// A corrupt partial file must not be resumed later on.
+			os.Remove(partial)
+			return err
+		}
+	}
+
+	if err := os.Chmod(partial, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(partial, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, target); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(target))
+}
+
+// openPartial opens the partial file and returns the offset to continue copying from, the file
+// is started over when it is not a prefix of source.
+func openPartial(partial string, source io.ReaderAt, size int64) (*os.File, int64, error) {
+	out, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		out.Close()
+		return nil, 0, err
+	}
+
+	offset := info.Size()
+	if offset > 0 && (offset > size || !samePrefix(out, source, offset)) {
+		log.WithFields(log.Fields{"partial": partial}).Warnln("Partial file does not match the source, starting over.")
+		offset = 0
+	}
+	if err := out.Truncate(offset); err != nil {
+		out.Close()
+		return nil, 0, err
+	}
+	return out, offset, nil
+}
+
+// samePrefix compares the first n bytes of a and b.
+func samePrefix(a, b io.ReaderAt, n int64) bool {
+	bufA, bufB := make([]byte, copyBufferSize), make([]byte, copyBufferSize)
+	for off := int64(0); off < n; off += copyBufferSize {
+		size := n - off
+		if size > copyBufferSize {
+			size = copyBufferSize
+		}
+		if _, err := a.ReadAt(bufA[:size], off); err != nil && err != io.EOF {
+			return false
+		}
+		if _, err := b.ReadAt(bufB[:size], off); err != nil && err != io.EOF {
+			return false
+		}
+		if !bytes.Equal(bufA[:size], bufB[:size]) {
+			return false
+		}
+	}
+	return true
+}
+
+func verifyCopy(source, copy string) error {
+	sourceHash, err := fileHash(source)
+	if err != nil {
+		return err
+	}
+	copyHash, err := fileHash(copy)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sourceHash, copyHash) {
+		return fmt.Errorf("checksum of the copy of '%s' does not match", source)
+	}
+	return nil
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, f, make([]byte, copyBufferSize)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyProgress logs the progress of a copy every copyProgressInterval.
+type copyProgress struct {
+	target string
+	total  int64
+	copied int64
+	last   time.Time
+}
+
+func (p *copyProgress) Write(b []byte) (int, error) {
+	p.copied += int64(len(b))
+	if time.Since(p.last) >= copyProgressInterval {
+		p.last = time.Now()
+		percent := 100.0
+		if p.total > 0 {
+			percent = float64(p.copied) * 100 / float64(p.total)
+		}
+		log.WithFields(log.Fields{"target": p.target, "copied": p.copied, "size": p.total}).Infof("Copying, %.1f%% done", percent)
+	}
+	return len(b), nil
+}
+
+// syncDir makes sure a rename in dir survives a crash, not every platform supports syncing a
+// directory so errors are ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaServerTypes are the supported media servers.
+var mediaServerTypes = map[string]bool{
+	"plex":     true,
+	"jellyfin": true,
+	"emby":     true,
+	"olaris":   true,
+}
+
+// mediaServerTimeout limits every request to a media server.
+const mediaServerTimeout = 30 * time.Second
+
+// MediaServer is a media server that is asked to refresh the folders touched by a run.
+type MediaServer struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	// Section is the Plex library section ID, it is looked up for every folder when empty.
+	Section string `json:"section,omitempty"`
+}
+
+func (m *MediaServer) validate() error {
+	if !mediaServerTypes[m.Type] {
+		return fmt.Errorf("unknown type '%s', valid types are plex, jellyfin, emby and olaris", m.Type)
+	}
+	u, err := url.Parse(m.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid url '%s'", m.URL)
+	}
+	m.URL = strings.TrimSuffix(m.URL, "/")
+	return nil
+}
+
+// touchedFolders returns the library folders files were put in, sorted and without duplicates.
+func touchedFolders(operations []PlannedOperation) []string {
+	seen := make(map[string]bool)
+	var folders []string
+	for _, op := range operations {
+		if !placed(op.Result) {
+			continue
+		}
+		folder, err := filepath.Abs(filepath.Dir(op.TargetPath))
+		if err != nil || seen[folder] {
+			continue
+		}
+		seen[folder] = true
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// refreshMediaServers asks every configured media server to refresh the folders the run put
+// files in. Failures are only logged, the files are in place already.
+func (e *App) refreshMediaServers(operations []PlannedOperation) {
+	folders := touchedFolders(operations)
+	if len(e.mediaServers) == 0 || len(folders) == 0 {
+		return
+	}
+	client := &http.Client{Timeout: mediaServerTimeout}
+	for i := range e.mediaServers {
+		m := &e.mediaServers[i]
+		logger := log.WithFields(log.Fields{"server": m.Type, "url": m.URL, "folders": len(folders)})
+		if e.mode == "dry-run" {
+			for _, folder := range folders {
+				logger.WithField("folder", folder).Infoln("DRY-RUN: Would ask media server to refresh folder")
+			}
+			continue
+		}
+		if err := m.refresh(client, folders); err != nil {
+			logger.WithError(err).Warnln("Could not refresh media server")
+			continue
+		}
+		logger.Infoln("Asked media server to refresh")
+	}
+}
+
+func (m *MediaServer) refresh(client *http.Client, folders []string) error {
+	switch m.Type {
+	case "plex":
+		return m.refreshPlex(client, folders)
+	case "jellyfin", "emby":
+		return m.refreshJellyfin(client, folders)
+	case "olaris":
+		return m.refreshOlaris(client, folders)
+	}
+	return fmt.Errorf("unknown media server type '%s'", m.Type)
+}
+
+// plexSections is the part of the /library/sections response used to find the section of a
+// folder.
+type plexSections struct {
+	MediaContainer struct {
+		Directory []struct {
+			Key      string `json:"key"`
+			Location []struct {
+				Path string `json:"path"`
+			} `json:"Location"`
+		} `json:"Directory"`
+	} `json:"MediaContainer"`
+}
+
+// refreshPlex starts a partial scan of every folder in the library section it belongs to.
+func (m *MediaServer) refreshPlex(client *http.Client, folders []string) error {
+	var sections plexSections
+	if m.Section == "" {
+		if err := m.do(client, http.MethodGet, "/library/sections", nil, &sections); err != nil {
+			return err
+		}
+	}
+	for _, folder := range folders {
+		section := m.Section
+		for _, dir := range sections.MediaContainer.Directory {
+			for _, location := range dir.Location {
+				if folder == location.Path || strings.HasPrefix(folder, strings.TrimSuffix(location.Path, "/")+"/") {
+					section = dir.Key
+				}
+			}
+		}
+		if section == "" {
+			log.WithFields(log.Fields{"folder": folder, "url": m.URL}).Warnln("Folder is not part of a Plex library, not refreshing it")
+			continue
+		}
+		path := fmt.Sprintf("/library/sections/%s/refresh?path=%s", url.PathEscape(section), url.QueryEscape(folder))
+		if err := m.do(client, http.MethodGet, path, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshJellyfin reports all folders as updated in a single request, Emby has the same API.
+func (m *MediaServer) refreshJellyfin(client *http.Client, folders []string) error {
+	type update struct {
+		Path       string `json:"Path"`
+		UpdateType string `json:"UpdateType"`
+	}
+	body := struct {
+		Updates []update `json:"Updates"`
+	}{}
+	for _, folder := range folders {
+		body.Updates = append(body.Updates, update{Path: folder, UpdateType: "Created"})
+	}
+	return m.do(client, http.MethodPost, "/Library/Media/Updated", body, nil)
+}
+
+// refreshOlaris rescans all folders with one GraphQL request.
+func (m *MediaServer) refreshOlaris(client *http.Client, folders []string) error {
+	var params, fields []string
+	variables := make(map[string]string)
+	for i, folder := range folders {
+		params = append(params, fmt.Sprintf("$p%d: String!", i))
+		fields = append(fields, fmt.Sprintf("r%d: rescanLibraries(filePath: $p%d)", i, i))
+		variables[fmt.Sprintf("p%d", i)] = folder
+	}
+	query := fmt.Sprintf("mutation(%s) { %s }", strings.Join(params, ", "), strings.Join(fields, " "))
+
+	var resp struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	body := map[string]interface{}{"query": query, "variables": variables}
+	if err := m.do(client, http.MethodPost, "/olaris/m/query", body, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("olaris-server returned an error: %s", resp.Errors[0].Message)
+	}
+	return nil
+}
+
+// do sends a request with the token of the server, body is sent and result is decoded as JSON
+// when they are not nil.
+func (m *MediaServer) do(client *http.Client, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, m.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch m.Type {
+	case "plex":
+		req.Header.Set("X-Plex-Token", m.Token)
+	case "jellyfin", "emby":
+		req.Header.Set("X-Emby-Token", m.Token)
+	case "olaris":
+		req.Header.Set("Authorization", "Bearer "+m.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
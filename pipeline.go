@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// identifiedFile is the result of identifying a single file
+type identifiedFile struct {
+	path string
+	file identify.ParsedFile
+	// skip is set when the file should not be acted upon, for example when it is too small.
+	skip bool
+	logs *bytes.Buffer
+}
+
+// flushLogs writes the buffered log output of the file to the standard logger.
+func (r identifiedFile) flushLogs() {
+	if r.logs != nil && r.logs.Len() > 0 {
+		log.StandardLogger().Out.Write(r.logs.Bytes())
+		r.logs.Reset()
+	}
+}
+
+// newBufferedLogger returns a logger that behaves like the standard logger but writes into a buffer.
+func newBufferedLogger() (*log.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	std := log.StandardLogger()
+	l := log.New()
+	l.Out = buf
+	l.Formatter = std.Formatter
+	l.Level = std.GetLevel()
+	return l, buf
+}
+
+// discoverFiles returns the sorted list of files to process for the given path.
+func (e *App) discoverFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	if !e.recursive {
+		log.Infof("Scanning non-recursive path '%s'", path)
+		files, err = filepath.Glob(filepath.Join(path, "*"))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Infof("Scanning path '%s' recursively", path)
+		err = filepath.Walk(path+"/", func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// identifyFiles identifies the given files using a pool of e.jobs workers. The callback is invoked
+// for every file in the order of paths, as soon as that file and all files before it are done,
+// so the output of a run does not depend on the amount of workers.
+func (e *App) identifyFiles(paths []string, mode string, fn func(identifiedFile)) {
+	jobs := e.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	results := make([]chan identifiedFile, len(paths))
+	for i := range results {
+		results[i] = make(chan identifiedFile, 1)
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				logger, buf := newBufferedLogger()
+				res := e.identifyFile(paths[i], mode, logger)
+				res.logs = buf
+				results[i] <- res
+			}
+		}()
+	}
+
+	go func() {
+		for i := range paths {
+			queue <- i
+		}
+		close(queue)
+	}()
+
+	for i := range results {
+		res := <-results[i]
+		res.flushLogs()
+		fn(res)
+	}
+	wg.Wait()
+}
+
+// identifyFile checks whether the given file should be processed and parses it.
+func (e *App) identifyFile(filePath string, mode string, logger log.FieldLogger) identifiedFile {
+	res := identifiedFile{path: filePath, skip: true}
+	logger.WithFields(log.Fields{"filePath": filePath}).Debugln("checking file")
+
+	ext := filepath.Ext(filePath)
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err, "filePath": filePath}).Errorln("received error while statting file.")
+		return res
+	}
+	if !info.Mode().IsRegular() {
+		logger.WithFields(log.Fields{"filePath": filePath}).Debugln("File is a directory, moving on.")
+		return res
+	}
+
+	// Extras like trailers are usually small, they would never make it past the size limit. They
+	// are only let through when they get a place of their own.
+	if identify.SupportedVideoExtensions[ext] && (e.extrasFormat == "" || !identify.IsExtra(filePath)) {
+		if info.Size() < e.minFileSizeBytes() {
+			logger.WithFields(log.Fields{"filePath": filePath, "minSize": e.minFileSizeBytes(), "size": info.Size()}).Warnln("file is smaller then the given limit, not processing.")
+			return res
+		}
+	}
+
+	opts := e.identifyOptions(mode)
+	opts.Logger = logger
+	res.file = identify.NewParsedFile(filePath, opts)
+
+	if res.file.LookupFailed {
+		logger.WithFields(log.Fields{"filePath": filePath}).Warnln("Metadata lookup failed, holding back file so it does not get a degraded name.")
+		return res
+	}
+
+	if err := e.applyOverride(&res.file, logger); identify.IsUnavailable(err) {
+		logger.WithFields(log.Fields{"filePath": filePath, "error": err}).Warnln("Metadata lookup failed, holding back file so it does not get a degraded name.")
+		return res
+	}
+
+	res.skip = false
+	return res
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// planVersion is the version of the plan file format.
+const planVersion = 1
+
+// Plan is a dry-run written to a file with --plan-out, the apply command executes it later.
+type Plan struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Action  string    `json:"action"`
+	// Root is the scanned path, --cleanup never removes folders outside of it.
+	Root       string             `json:"root"`
+	Operations []PlannedOperation `json:"operations"`
+}
+
+// FileState describes a file so changes can be detected.
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode,omitempty"`
+}
+
+func fileState(path string) (*FileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileState{Size: info.Size(), ModTime: info.ModTime(), Inode: inode(info)}, nil
+}
+
+// matches returns whether the file still looks the same, the inode is only compared when it
+// is known.
+func (s *FileState) matches(info os.FileInfo) bool {
+	return info.Size() == s.Size && info.ModTime().Equal(s.ModTime) && (s.Inode == 0 || inode(info) == s.Inode)
+}
+
+// writePlan writes the planned operations of the run to path.
+func writePlan(path, root, action string, operations []PlannedOperation) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	plan := Plan{Version: planVersion, Created: time.Now(), Action: action, Root: root, Operations: operations}
+	if plan.Operations == nil {
+		plan.Operations = []PlannedOperation{}
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func readPlan(path string) (*Plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	plan := &Plan{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(plan); err != nil {
+		return nil, fmt.Errorf("could not read plan '%s': %s", path, err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("plan '%s' has version %d, only version %d is supported", path, plan.Version, planVersion)
+	}
+	if !actions[plan.Action] {
+		return nil, fmt.Errorf("plan '%s' has an unknown action '%s'", path, plan.Action)
+	}
+	return plan, nil
+}
+
+// checkPlanned returns why an operation of a plan can't be executed anymore, nil when it still
+// can.
+func checkPlanned(plan *Plan, op PlannedOperation) error {
+	if op.Action != plan.Action {
+		return fmt.Errorf("action '%s' differs from the action of the plan '%s'", op.Action, plan.Action)
+	}
+	if !filepath.IsAbs(op.SourcePath) || !filepath.IsAbs(op.TargetPath) {
+		return fmt.Errorf("source and target have to be absolute paths")
+	}
+	if op.SourceState == nil {
+		return fmt.Errorf("the plan has no state of the source to check")
+	}
+	info, err := os.Stat(op.SourcePath)
+	if err != nil {
+		return fmt.Errorf("source is gone: %w", err)
+	}
+	if !op.SourceState.matches(info) {
+		return fmt.Errorf("source changed since the plan was made")
+	}
+	return nil
+}
+
+// applyPlan executes the operations of the plan that are still valid, it returns the executed
+// operations and the amount of refused ones.
+func (e *App) applyPlan(plan *Plan) ([]PlannedOperation, int) {
+	var operations []PlannedOperation
+	refused := 0
+	for _, op := range plan.Operations {
+		op.Result = ""
+		if !op.Skip {
+			if err := checkPlanned(plan, op); err != nil {
+				log.WithFields(log.Fields{"source": op.SourcePath, "target": op.TargetPath, "error": err}).Errorln("Refusing outdated operation")
+				refused++
+				continue
+			}
+		}
+		operations = append(operations, op)
+	}
+	e.finishRun(plan.Root, operations)
+	return operations, refused
+}
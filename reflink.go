@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errReflinkUnsupported = errors.New("reflinks are not supported on this platform")
+
+// reflinkFallbacks are the actions --action=reflink can fall back to.
+var reflinkFallbacks = map[string]bool{
+	"copy":     true,
+	"hardlink": true,
+	"none":     true,
+}
+
+// reflinkFile creates target as a copy-on-write clone of source. When the filesystem doesn't
+// support that the fallback action is used instead, unless it is "none".
+func reflinkFile(source, target string, opts transferOptions) error {
+	err := reflink(source, target)
+	if err == nil || !reflinkUnsupported(err) || opts.reflinkFallback == "none" {
+		return err
+	}
+
+	log.WithFields(log.Fields{"source": source, "target": target, "fallback": opts.reflinkFallback, "error": err}).Infoln("Filesystem does not support reflinks, falling back.")
+	return transfer(source, target, opts.reflinkFallback, opts)
+}
+
+func reflink(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := cloneFile(in, out); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	// The clone is a new file, keep it looking like the source the way copies do.
+	if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl from linux/fs.h.
+const ficlone = 0x40049409
+
+// cloneFile makes target share the data blocks of source on filesystems with copy-on-write
+// support like btrfs and XFS.
+func cloneFile(source, target *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, target.Fd(), ficlone, source.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// reflinkUnsupported returns whether err means the filesystem can't clone between the files.
+func reflinkUnsupported(err error) bool {
+	switch err {
+	case syscall.EOPNOTSUPP, syscall.ENOTTY, syscall.EXDEV, syscall.EINVAL, syscall.ENOSYS, errReflinkUnsupported:
+		return true
+	}
+	return false
+}
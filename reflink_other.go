@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// cloneFile is only supported on linux.
+func cloneFile(source, target *os.File) error {
+	return errReflinkUnsupported
+}
+
+func reflinkUnsupported(err error) bool {
+	return err == errReflinkUnsupported
+}
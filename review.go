@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// reviewOperations lets the user go through the planned operations one by one. Every operation
+// can be accepted, skipped, given another target or identified again with a different title.
+// It returns false when the user cancelled the run.
+func (e *App) reviewOperations(in *bufio.Reader, operations []PlannedOperation) bool {
+	if len(operations) == 0 {
+		fmt.Println("No files to process.")
+		return false
+	}
+	fmt.Printf("\nFound %d file(s) to process.\n", len(operations))
+
+	for i := 0; i < len(operations); i++ {
+		op := &operations[i]
+		fmt.Printf("\n[%d/%d] ", i+1, len(operations))
+		e.printOperation(*op)
+
+		def := "y"
+		if op.Skip {
+			def = "n"
+		}
+		fmt.Printf("Accept? [y]es, [n]o (skip), [e]dit target, [r]e-identify, [a]ccept all remaining, [q]uit (default %s): ", def)
+		response, err := readLine(in)
+		if err != nil {
+			log.WithError(err).Errorln("Error reading user input")
+			return false
+		}
+		if response == "" {
+			response = def
+		}
+
+		switch response {
+		case "y", "yes":
+			e.selectOperation(operations, i)
+		case "n", "no":
+			op.Skip = true
+		case "a":
+			var remaining []int
+			for j := i; j < len(operations); j++ {
+				remaining = append(remaining, j)
+			}
+			selectOperations(operations, remaining)
+			i = len(operations)
+		case "q":
+			return false
+		case "e":
+			fmt.Printf("New target (relative to %s): ", e.targetBase(*op))
+			target, err := readLine(in)
+			if err != nil || target == "" {
+				fmt.Println("Target not changed.")
+			} else if err := e.editTarget(op, target); err != nil {
+				fmt.Printf("Could not change the target: %s\n", err)
+			} else {
+				e.updateCollisions(operations, i)
+			}
+			// Show the operation again so the change can be checked.
+			i--
+		case "r":
+			fmt.Print("Title: ")
+			title, err := readLine(in)
+			if err != nil || title == "" {
+				fmt.Println("File not identified again.")
+				i--
+				continue
+			}
+			fmt.Print("Year (optional): ")
+			year, _ := readLine(in)
+			if err := e.reidentify(op, title, year); err != nil {
+				fmt.Printf("Could not identify the file again: %s\n", err)
+			} else {
+				e.updateCollisions(operations, i)
+			}
+			i--
+		default:
+			fmt.Printf("Unknown answer '%s'.\n", response)
+			i--
+		}
+	}
+
+	skipped := 0
+	for _, op := range operations {
+		if op.Skip {
+			skipped++
+		}
+	}
+	fmt.Printf("\n%d file(s) accepted, %d skipped.\n", len(operations)-skipped, skipped)
+	return true
+}
+
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// printOperation shows an operation with everything planning found out about it, paths are
+// relative to the working directory when possible.
+func (e *App) printOperation(op PlannedOperation) {
+	fromPath := op.SourcePath
+	toPath := op.TargetPath
+	if cwd, err := os.Getwd(); err == nil {
+		if relFrom, err := filepath.Rel(cwd, op.SourcePath); err == nil {
+			fromPath = relFrom
+		}
+		if relTo, err := filepath.Rel(cwd, op.TargetPath); err == nil {
+			toPath = relTo
+		}
+	}
+
+	fmt.Printf("%s\n", op.Action)
+	fmt.Printf("   From: %s\n", fromPath)
+	fmt.Printf("   To:   %s\n", toPath)
+	if op.Inferior {
+		fmt.Println("   Skipped: the library already has this in the same or a better quality")
+	}
+	for _, replaced := range op.Replaces {
+		fmt.Printf("   Upgrade: replaces %s\n", replaced)
+	}
+	if op.Lost {
+		fmt.Println("   Skipped: another file in this run has the same target")
+	} else if len(op.CollidesWith) > 0 {
+		fmt.Printf("   Collision: kept over %s\n", strings.Join(op.CollidesWith, ", "))
+	}
+	if op.Conflict && len(op.Replaces) == 0 && !op.Inferior {
+		fmt.Printf("   Conflict: target already exists (--on-conflict=%s)\n", e.onConflict)
+	}
+}
+
+// targetBase is the folder relative targets given by the user are placed in.
+func (e *App) targetBase(op PlannedOperation) string {
+	if e.action == "rename" {
+		return filepath.Dir(op.SourcePath)
+	}
+	return e.targetFolder(op.File)
+}
+
+// editTarget changes the target of an operation, relative targets are placed in targetBase.
+func (e *App) editTarget(op *PlannedOperation, target string) error {
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(e.targetBase(*op), target)
+	}
+	source, err := filepath.Abs(op.SourcePath)
+	if err != nil {
+		return err
+	}
+	target = filepath.Clean(target)
+	if target == source {
+		return fmt.Errorf("target is the source itself")
+	}
+
+	upgrade := e.checkUpgrade(op.File, source, target)
+	op.TargetPath = target
+	op.Conflict = targetConflicts(source, target)
+	op.Replaces = upgrade.Replaces
+	op.Inferior = upgrade.Inferior
+	op.Skip = false
+	return nil
+}
+
+// reidentify identifies the file of the operation again using the given title and year and
+// plans it again.
+func (e *App) reidentify(op *PlannedOperation, title, year string) error {
+	// The file is parsed without a lookup, the name it has is wrong after all.
+	opts := e.identifyOptions("dry-run")
+	lookup := opts.Lookup
+	opts.Lookup = false
+	file := identify.NewParsedFile(op.SourcePath, opts)
+	file.Options.Lookup = lookup
+
+	if err := file.Reidentify(title, year); err != nil {
+		return err
+	}
+	if err := e.applyOverride(&file, log.StandardLogger()); err != nil {
+		return err
+	}
+	planned, ok := e.planOperation(identifiedFile{path: op.SourcePath, file: file})
+	if !ok {
+		return fmt.Errorf("'%s' is not recognized as a movie or episode", op.SourcePath)
+	}
+	*op = planned
+	return nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// key is a key press, name is set for keys that are not printable like "up" or "enter".
+type key struct {
+	r    rune
+	name string
+}
+
+// readKey reads a single key press from a terminal in raw mode.
+func readKey(in *bufio.Reader) (key, error) {
+	r, _, err := in.ReadRune()
+	if err != nil {
+		return key{}, err
+	}
+	switch r {
+	case '\r', '\n':
+		return key{name: "enter"}, nil
+	case 127, '\b':
+		return key{name: "backspace"}, nil
+	case 3:
+		return key{name: "ctrl-c"}, nil
+	case 27:
+		// Terminals send escape sequences in one go, a lone escape is the escape key.
+		if in.Buffered() == 0 {
+			return key{name: "esc"}, nil
+		}
+		seq, _ := in.ReadByte()
+		if seq != '[' && seq != 'O' {
+			return key{name: "esc"}, nil
+		}
+		code, _ := in.ReadByte()
+		names := map[byte]string{'A': "up", 'B': "down", 'C': "right", 'D': "left", 'H': "home", 'F': "end"}
+		if name, ok := names[code]; ok {
+			return key{name: name}, nil
+		}
+		if code >= '0' && code <= '9' {
+			in.ReadByte() // the closing ~
+			switch code {
+			case '1', '7':
+				return key{name: "home"}, nil
+			case '4', '8':
+				return key{name: "end"}, nil
+			case '5':
+				return key{name: "pgup"}, nil
+			case '6':
+				return key{name: "pgdn"}, nil
+			}
+		}
+		return key{}, nil
+	}
+	return key{r: r}, nil
+}
+
+// planRow is a line in the plan view, either the header of a group or an operation.
+type planRow struct {
+	group string
+	op    int
+}
+
+// planView is the state of the full-screen plan review, it is kept apart from the terminal
+// so it can be tested.
+type planView struct {
+	e      *App
+	ops    []PlannedOperation
+	rows   []planRow
+	edited map[int]bool
+	cursor int
+	offset int
+	filter string
+	// state is "filter", "edit" or "confirm" while the footer asks for input.
+	state string
+	input string
+	// message is shown in the footer until the next key press.
+	message string
+}
+
+func newPlanView(e *App, ops []PlannedOperation) *planView {
+	v := &planView{e: e, ops: ops, edited: make(map[int]bool)}
+	v.buildRows()
+	return v
+}
+
+// groupName returns the group an operation is shown in, episodes are grouped by show and
+// season.
+func groupName(op PlannedOperation) string {
+	if op.File.IsSeries {
+		return fmt.Sprintf("%s / Season %s", op.File.CleanName, op.File.Season)
+	}
+	return "Movies"
+}
+
+// buildRows groups the operations matching the filter.
+func (v *planView) buildRows() {
+	filter := strings.ToLower(v.filter)
+	groups := make(map[string][]int)
+	var names []string
+	for i, op := range v.ops {
+		group := groupName(op)
+		text := strings.ToLower(strings.Join([]string{op.SourcePath, op.TargetPath, group}, "\n"))
+		if filter != "" && !strings.Contains(text, filter) {
+			continue
+		}
+		if _, ok := groups[group]; !ok {
+			names = append(names, group)
+		}
+		groups[group] = append(groups[group], i)
+	}
+	sort.Strings(names)
+
+	v.rows = nil
+	for _, name := range names {
+		v.rows = append(v.rows, planRow{group: name, op: -1})
+		for _, i := range groups[name] {
+			v.rows = append(v.rows, planRow{group: name, op: i})
+		}
+	}
+	if v.cursor >= len(v.rows) {
+		v.cursor = len(v.rows) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+}
+
+// status describes an operation in a single word.
+func (v *planView) status(i int) string {
+	op := v.ops[i]
+	switch {
+	case op.Inferior:
+		return "inferior"
+	case len(op.Replaces) > 0:
+		return "upgrade"
+	case op.Lost:
+		return "collision"
+	case op.Conflict:
+		return "conflict"
+	case v.edited[i]:
+		return "edited"
+	case v.e.tmdbLookup && op.File.ExternalID == 0:
+		return "low-confidence"
+	}
+	return "new"
+}
+
+// rowOps returns the operations of the row, all operations of the group for headers.
+func (v *planView) rowOps(row planRow) []int {
+	if row.op >= 0 {
+		return []int{row.op}
+	}
+	var ops []int
+	for _, r := range v.rows {
+		if r.group == row.group && r.op >= 0 {
+			ops = append(ops, r.op)
+		}
+	}
+	return ops
+}
+
+func (v *planView) selected() int {
+	n := 0
+	for _, op := range v.ops {
+		if !op.Skip {
+			n++
+		}
+	}
+	return n
+}
+
+// setVisible selects or deselects all operations matching the filter.
+func (v *planView) setVisible(selected bool) {
+	var ops []int
+	for _, row := range v.rows {
+		if row.op >= 0 {
+			ops = append(ops, row.op)
+		}
+	}
+	v.setSelected(ops, selected)
+}
+
+func (v *planView) toggle() {
+	if len(v.rows) == 0 {
+		return
+	}
+	row := v.rows[v.cursor]
+	if row.op >= 0 {
+		if v.ops[row.op].Skip {
+			v.e.selectOperation(v.ops, row.op)
+		} else {
+			v.ops[row.op].Skip = true
+		}
+		return
+	}
+
+	// A group with unselected operations is selected completely, otherwise deselected. Collision
+	// losers are left out, they are only selected one by one.
+	ops := v.rowOps(row)
+	selected := false
+	for _, i := range ops {
+		if v.ops[i].Skip && !v.ops[i].Lost {
+			selected = true
+		}
+	}
+	v.setSelected(ops, selected)
+}
+
+func (v *planView) setSelected(ops []int, selected bool) {
+	if selected {
+		selectOperations(v.ops, ops)
+		return
+	}
+	for _, i := range ops {
+		v.ops[i].Skip = true
+	}
+}
+
+func (v *planView) move(n int) {
+	v.cursor += n
+	if v.cursor >= len(v.rows) {
+		v.cursor = len(v.rows) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+}
+
+// handleKey updates the view, it returns whether the review is done and whether the selected
+// operations should be applied.
+func (v *planView) handleKey(k key) (bool, bool) {
+	v.message = ""
+	if k.name == "ctrl-c" {
+		return true, false
+	}
+
+	switch v.state {
+	case "filter", "edit":
+		switch {
+		case k.name == "esc":
+			if v.state == "filter" {
+				v.filter = ""
+				v.buildRows()
+			}
+			v.state = ""
+		case k.name == "enter" && v.state == "edit":
+			i := v.rows[v.cursor].op
+			if err := v.e.editTarget(&v.ops[i], v.input); err != nil {
+				v.message = fmt.Sprintf("Could not change the target: %s", err)
+			} else {
+				v.edited[i] = true
+				v.e.updateCollisions(v.ops, i)
+			}
+			v.state = ""
+		case k.name == "enter":
+			v.state = ""
+		case k.name == "backspace":
+			if r := []rune(v.input); len(r) > 0 {
+				v.input = string(r[:len(r)-1])
+			}
+		case k.name == "" && k.r >= ' ':
+			v.input += string(k.r)
+		}
+		if v.state == "filter" {
+			v.filter = v.input
+			v.buildRows()
+		}
+		return false, false
+	case "confirm":
+		v.state = ""
+		return k.r == 'y', k.r == 'y'
+	}
+
+	page := 10
+	switch {
+	case k.name == "up" || k.r == 'k':
+		v.move(-1)
+	case k.name == "down" || k.r == 'j':
+		v.move(1)
+	case k.name == "pgup":
+		v.move(-page)
+	case k.name == "pgdn":
+		v.move(page)
+	case k.name == "home" || k.r == 'g':
+		v.move(-len(v.rows))
+	case k.name == "end" || k.r == 'G':
+		v.move(len(v.rows))
+	case k.r == ' ':
+		v.toggle()
+	case k.r == 'a':
+		v.setVisible(true)
+	case k.r == 'n':
+		v.setVisible(false)
+	case k.r == '/':
+		v.state, v.input = "filter", v.filter
+	case k.r == 'e':
+		if len(v.rows) > 0 && v.rows[v.cursor].op >= 0 {
+			v.state, v.input = "edit", v.ops[v.rows[v.cursor].op].TargetPath
+		}
+	case k.name == "enter" || k.r == 'x':
+		v.state = "confirm"
+	case k.name == "esc" || k.r == 'q':
+		return true, false
+	}
+	return false, false
+}
+
+// render returns the lines of the screen, the row under the cursor is shown in reverse video.
+func (v *planView) render(width, height int) []string {
+	title := fmt.Sprintf("olaris-rename: %d file(s), %d selected", len(v.ops), v.selected())
+	if v.filter != "" {
+		title += fmt.Sprintf(", filter '%s'", v.filter)
+	}
+	lines := []string{title, ""}
+
+	body := height - 4
+	if body < 1 {
+		body = 1
+	}
+	if v.cursor < v.offset {
+		v.offset = v.cursor
+	}
+	if v.cursor >= v.offset+body {
+		v.offset = v.cursor - body + 1
+	}
+	for n := v.offset; n < len(v.rows) && n < v.offset+body; n++ {
+		line := truncate(v.rowText(v.rows[n]), width)
+		if n == v.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < height-2 {
+		lines = append(lines, "")
+	}
+
+	footer := "up/down move, space select, a/n select all/none, / filter, e edit target, enter apply, q quit"
+	switch {
+	case v.state == "filter":
+		footer = "Filter: " + v.input
+	case v.state == "edit":
+		footer = "Target: " + v.input
+	case v.state == "confirm":
+		footer = fmt.Sprintf("Apply %d selected operation(s)? (y/n)", v.selected())
+	case v.message != "":
+		footer = v.message
+	}
+	return append(lines, "", truncate(footer, width))
+}
+
+func (v *planView) rowText(row planRow) string {
+	ops := v.rowOps(row)
+	selected := 0
+	for _, i := range ops {
+		if !v.ops[i].Skip {
+			selected++
+		}
+	}
+	check := "[ ]"
+	if selected == len(ops) {
+		check = "[x]"
+	} else if selected > 0 {
+		check = "[-]"
+	}
+	if row.op < 0 {
+		return fmt.Sprintf("%s %s (%d/%d)", check, row.group, selected, len(ops))
+	}
+
+	op := v.ops[row.op]
+	target := op.TargetPath
+	if rel, err := filepath.Rel(v.e.targetBase(op), target); err == nil && !strings.HasPrefix(rel, "..") {
+		target = rel
+	}
+	return fmt.Sprintf("  %s %-14s %s -> %s", check, v.status(row.op), filepath.Base(op.SourcePath), target)
+}
+
+func truncate(s string, width int) string {
+	if r := []rune(s); width > 0 && len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// reviewInTerminalUI shows the plan in a full-screen view, the review loop is used when stdin
+// is not a terminal. It returns false when the user cancelled the run.
+func (e *App) reviewInTerminalUI(operations []PlannedOperation) bool {
+	if len(operations) == 0 {
+		fmt.Println("No files to process.")
+		return false
+	}
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		log.WithError(err).Warnln("Can't use the terminal UI, reviewing files one by one instead")
+		return e.reviewOperations(stdin, operations)
+	}
+	defer restore()
+
+	out := bufio.NewWriter(os.Stdout)
+	// Switch to the alternate screen and hide the cursor, both are undone when leaving.
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+		out.Flush()
+	}()
+
+	v := newPlanView(e, operations)
+	for {
+		width, height := terminalSize(fd)
+		draw(out, v.render(width, height))
+		k, err := readKey(stdin)
+		if err != nil {
+			return false
+		}
+		if done, apply := v.handleKey(k); done {
+			return apply
+		}
+	}
+}
+
+func draw(out *bufio.Writer, lines []string) {
+	fmt.Fprint(out, "\x1b[H")
+	for i, line := range lines {
+		fmt.Fprint(out, line, "\x1b[K")
+		if i < len(lines)-1 {
+			// Output processing is off in raw mode, so lines need a carriage return.
+			fmt.Fprint(out, "\r\n")
+		}
+	}
+	fmt.Fprint(out, "\x1b[J")
+	out.Flush()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/olaris/olaris-rename/identify"
+)
+
+// upgradeCheck is the outcome of comparing a file with the library.
+type upgradeCheck struct {
+	// Replaces are the existing files of the same movie or episode that are worse.
+	Replaces []string
+	// Inferior is set when an existing file is at least as good, the file is skipped then.
+	Inferior bool
+	Existing string
+}
+
+// checkUpgrade compares the file with the files of the same movie or episode in the target
+// folder. Only files in the folder the target ends up in are considered.
+func (e *App) checkUpgrade(file identify.ParsedFile, source, target string) upgradeCheck {
+	var check upgradeCheck
+	if !e.upgrade {
+		return check
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil {
+		return check
+	}
+	sourceInfo, _ := os.Stat(source)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !identify.SupportedVideoExtensions[filepath.Ext(entry.Name())] {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(target), entry.Name())
+		if info, err := os.Stat(path); err != nil || (sourceInfo != nil && os.SameFile(info, sourceInfo)) {
+			continue
+		}
+
+		existing := identify.NewParsedFile(path, identify.Options{Logger: file.Options.Logger})
+		if !identify.SameIdentity(file, existing) {
+			continue
+		}
+		if e.compareWithLibrary(file, source, existing, path) <= 0 {
+			return upgradeCheck{Inferior: true, Existing: path}
+		}
+		check.Replaces = append(check.Replaces, path)
+	}
+	return check
+}
+
+// compareWithLibrary ranks file against a file of the library. Only the quality properties the
+// existing file shows are compared, when those are equal and some are unknown the larger file
+// wins since the name can't tell anymore.
+func (e *App) compareWithLibrary(file identify.ParsedFile, source string, existing identify.ParsedFile, path string) int {
+	if c := e.qualityRanking.Compare(file, withKnownQuality(existing, file)); c != 0 {
+		return c
+	}
+	if existing.Resolution != "" && existing.Quality != "" && existing.Codec != "" {
+		return 0
+	}
+	return compareSizes(source, path)
+}
+
+// withKnownQuality fills the quality attributes the existing file does not show with the ones
+// of file. Library files are renamed and usually lost most of them, unknown is not worse.
+func withKnownQuality(existing, file identify.ParsedFile) identify.ParsedFile {
+	if existing.Resolution == "" {
+		existing.Resolution = file.Resolution
+	}
+	if existing.Quality == "" {
+		existing.Quality = file.Quality
+	}
+	if existing.Codec == "" {
+		existing.Codec = file.Codec
+	}
+	if !existing.Proper && !existing.Repack {
+		existing.Proper, existing.Repack = file.Proper, file.Repack
+	}
+	return existing
+}
+
+// trashFolder returns the folder replaced files are moved to.
+func (e *App) trashFolder() string {
+	if e.trash != "" {
+		return e.trash
+	}
+	return configFolderPath("trash")
+}
+
+// moveToTrash moves a replaced file into the trash folder, the move is journaled so undo puts
+// it back.
+func (e *App) moveToTrash(path string) error {
+	dir := filepath.Join(e.trashFolder(), time.Now().Format("2006-01-02"))
+	created := missingDirs(dir)
+	if err := ensurePath(dir); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Lstat(target); err == nil {
+		target = suffixedTarget(target)
+	}
+
+	log.WithFields(log.Fields{"file": path, "trash": target}).Infoln("Moving replaced file to the trash folder")
+	if err := transfer(path, target, "move", transferOptions{verify: true}); err != nil {
+		return err
+	}
+	if e.journal != nil {
+		if err := e.journal.recordOperation("move", path, target, created); err != nil {
+			log.WithFields(log.Fields{"error": err, "target": target}).Errorln("Could not record operation in the journal")
+		}
+	}
+	return nil
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}